@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/vanilla-os/almost/core"
+)
+
+func attrUsage(*cobra.Command) error {
+	fmt.Print(`Description: 
+	Show and change the file attributes, without the chattr and lsattr
+	utilities.
+
+Usage:
+	attr [options] [command]
+
+Options:
+	--help/-h		show this message
+	--recursive/-R		process directories and their content recursively
+	--long/-l		list the attribute names instead of the lsattr letters
+
+Commands:
+	get [path...]		show the attributes of the given paths
+	set [path] [attr...]	set the given attributes
+	unset [path] [attr...]	unset the given attributes
+	list			list the known attribute names
+
+Attributes are given by name (immutable, append, nodump, nocow, noatime..)
+or by their chattr letter (i, a, d, C, A..).
+
+Examples:
+	almost attr get /usr/bin/bash
+	almost attr get -R -l /opt
+	almost attr set /var/log/audit append
+	almost attr unset -R /opt/vendor immutable nodump
+`)
+	return nil
+}
+
+func NewAttrCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "attr",
+		Short:        "Show and change the file attributes",
+		RunE:         attr,
+		SilenceUsage: true,
+	}
+	cmd.SetUsageFunc(attrUsage)
+	cmd.Flags().BoolP("recursive", "R", false, "process directories and their content recursively")
+	cmd.Flags().BoolP("long", "l", false, "list the attribute names instead of the lsattr letters")
+	return cmd
+}
+
+func attr(cmd *cobra.Command, args []string) error {
+	recursive, _ := cmd.Flags().GetBool("recursive")
+	long, _ := cmd.Flags().GetBool("long")
+
+	if len(args) == 0 {
+		return attrUsage(cmd)
+	}
+
+	switch args[0] {
+	case "get":
+		if len(args) < 2 {
+			return fmt.Errorf("missing path")
+		}
+		return attrGet(args[1:], recursive, long)
+	case "set", "unset":
+		if !core.RootCheck(true) {
+			return nil
+		}
+		if len(args) < 3 {
+			return fmt.Errorf("missing path or attributes")
+		}
+		attrs, err := core.ParseAttrs(args[2:])
+		if err != nil {
+			return err
+		}
+		if args[0] == "set" {
+			return attrChange(args[1], attrs, 0, recursive)
+		}
+		return attrChange(args[1], 0, attrs, recursive)
+	case "list":
+		for _, flag := range core.AttrFlags {
+			fmt.Printf("%c\t%s\n", flag.Letter, flag.Name)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+}
+
+func attrGet(paths []string, recursive bool, long bool) error {
+	failed := 0
+
+	for _, path := range paths {
+		states, err := core.QueryPathAttrs(path, recursive)
+		if err != nil {
+			fmt.Printf("Error: %s: %s\n", path, err)
+			failed++
+			continue
+		}
+
+		for _, state := range states {
+			switch {
+			case state.Err != nil:
+				fmt.Printf("Error: %s: %s\n", state.Path, state.Err)
+				failed++
+			case long:
+				names := core.AttrFlagNames(state.Attrs)
+				if len(names) == 0 {
+					names = []string{"---"}
+				}
+				fmt.Printf("%-40s %s\n", state.Path, strings.Join(names, ", "))
+			default:
+				fmt.Printf("%s %s\n", core.FormatAttrs(state.Attrs), state.Path)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d path(s) could not be read", failed)
+	}
+	return nil
+}
+
+func attrChange(path string, set int32, unset int32, recursive bool) error {
+	summary, err := core.ChangePathAttrs(path, set, unset, recursive)
+	if err != nil {
+		return err
+	}
+
+	for _, failure := range summary.Failures {
+		fmt.Println("Error:", failure.Error())
+	}
+	fmt.Printf("%d changed, %d unchanged, %d skipped, %d failed.\n",
+		summary.Changed, summary.Unchanged, summary.Skipped, summary.Failed)
+
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d file(s) failed", summary.Failed)
+	}
+	return nil
+}
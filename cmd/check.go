@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/vanilla-os/almost/core"
@@ -9,7 +10,8 @@ import (
 
 func checkUsage(*cobra.Command) error {
 	fmt.Print(`Description: 
-	Check whether the filesystem is read-only or read-write.
+	Check whether the filesystem is read-only or read-write, for the system
+	as a whole and for every managed path.
 
 Usage:
 	check [options] [command]
@@ -38,16 +40,65 @@ func check(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
-	mode, err := core.Get("Almost::CurrentMode")
+	mode, err := core.CurrentMode()
 	if err != nil {
 		return err
 	}
-	if mode == "0" {
+	switch mode {
+	case core.ModeRo:
 		fmt.Println("Mode: ro")
 		fmt.Println("System is read-only")
-	} else {
+	case core.ModeMixed:
+		fmt.Println("Mode: mixed")
+		fmt.Println("System is partially read-write")
+	default:
 		fmt.Println("Mode: rw")
 		fmt.Println("System is read-write")
 	}
+
+	rules, err := core.LoadPathRules()
+	if err != nil {
+		return err
+	}
+	state, err := core.LoadModeState()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("\nManaged paths:")
+	for _, path := range rules.Resolve() {
+		policy := rules.PolicyOf(path)
+		line := fmt.Sprintf("- %s: %s", path, core.ModeName(state.ModeOf(path)))
+		if policy.Default != "" {
+			line += fmt.Sprintf(" (default %s)", core.ModeName(policy.Default))
+		}
+		if policy.Group != "" {
+			line += fmt.Sprintf(" [%s]", policy.Group)
+		}
+		fmt.Println(line)
+	}
+
+	leases, err := core.ListLeases()
+	if err != nil {
+		return err
+	}
+	if len(leases) > 0 {
+		fmt.Println("\nRead-write leases:")
+		for _, lease := range leases {
+			fmt.Printf("- %s (pid %d) since %s\n", lease.Command, lease.Pid, lease.Since.Format(time.Kitchen))
+		}
+	}
+
+	if state.Window != nil {
+		fmt.Printf("\nRead-write window: %s remaining (relocks at %s)\n",
+			state.Window.Remaining().Round(time.Second), state.Window.Expires.Format(time.Kitchen))
+	}
+
+	if last := state.LastTransition; last != nil {
+		fmt.Printf("\nLast transition: %s at %s (%s)\n", last.Mode, last.Time.Format(time.Stamp), last.Reason)
+		if last.Failed > 0 {
+			fmt.Printf("%d file(s) failed\n", last.Failed)
+		}
+	}
 	return nil
 }
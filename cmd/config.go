@@ -16,13 +16,79 @@ Usage:
 
 Options:
 	--help/-h		show this message
+	--origin		show the layer every value comes from
+	--runtime		with set and unset, change the runtime layer
 
 Commands:
+	get [key]		show a configuration value
 	set [key] [value]	set a configuration value
+	unset [key]		remove a key, the value of the lower layers applies
+	describe [key]		describe the configuration keys and their values
+
+	Keys can be given with or without the Almost:: prefix. Modes are ro or
+	rw and switches on or off, the former 0 and 1 values are still accepted.
+
+Layers:
+	The configuration is read from the following layers, each one overriding
+	the previous ones:
+
+	/usr/share/almost/almost.ini	vendor defaults
+	/etc/almost.ini			admin configuration, changed by set
+	/etc/almost.ini.d/*.ini		drop-ins, in lexical order
+	/run/almost/almost.ini		runtime overrides, lost on reboot
+
+	Keys live in the [Almost] section of every layer.
+
+Managed paths:
+	The list of managed paths can be extended with the Almost::IncludePaths
+	and Almost::ExcludePaths keys (comma separated glob patterns) or with
+	drop-in files in /etc/almost/paths.d/*.conf, e.g.:
+
+	include /opt default=rw group=vendor
+	include /boot/efi strategy=bindmount
+	exclude /usr/local
+	append /var/log/audit
+
+	Paths matching an append pattern are set append-only instead of
+	immutable when the system is locked. The default option overrides
+	Almost::DefaultMode for a path, the group option allows toggling several
+	paths together, e.g. almost enter rw vendor.
+
+Backends:
+	Almost::Backend selects how the managed paths are protected: chattr sets
+	the immutable flag on every file, bindmount makes the paths read-only bind
+	mounts without touching the on-disk flags.
+
+	With chattr, paths on file systems without support for file attributes
+	(tmpfs, vfat, fuse..) are handled according to Almost::UnsupportedFs: warn
+	leaves them unprotected, bindmount protects them with a read-only bind
+	mount and refuse makes lock and unlock fail. The strategy option of the
+	drop-in files forces one of chattr, bindmount or none for a path.
+
+Integrity:
+	With Almost::IntegrityManifest set to on, every time the system is locked
+	a manifest of the files in the managed paths is stored in
+	/etc/almost/manifest, signed with a local ed25519 key. Use
+	almost verify --integrity to compare the managed paths with it.
+
+Hooks:
+	Executables in /etc/almost/hooks.d/{pre,post}-{lock,unlock,state-new,
+	overlay-commit,overlay-discard} run in lexical order around the matching
+	event, with ALMOST_EVENT, ALMOST_HOOK (pre or post) and the event details
+	(ALMOST_MODE, ALMOST_PATHS, ALMOST_STATE_ID, ALMOST_OVERLAY_PATH..) in
+	their environment. A failing pre hook aborts the event, post hooks also
+	get ALMOST_RESULT (success or failure) and ALMOST_ERROR.
 
 Examples:
 	almost config
-	almost config set Almost::DefaultMode 1
+	almost config --origin
+	almost config get DefaultMode
+	almost config set Almost::DefaultMode rw
+	almost config set Almost::IncludePaths /opt,/boot
+	almost config set Almost::Backend bindmount
+	almost config set Almost::IntegrityManifest on
+	almost config unset Almost::Backend
+	almost config describe
 `)
 	return nil
 }
@@ -34,7 +100,11 @@ func NewConfigCommand() *cobra.Command {
 		RunE:  config,
 	}
 	cmd.SetUsageFunc(configUsage)
+	cmd.Flags().Bool("origin", false, "show the layer every value comes from")
+	cmd.AddCommand(CmdConfigGet())
 	cmd.AddCommand(CmdConfigSet())
+	cmd.AddCommand(CmdConfigUnset())
+	cmd.AddCommand(CmdConfigDescribe())
 	return cmd
 }
 
@@ -42,15 +112,46 @@ func config(cmd *cobra.Command, args []string) error {
 	if !core.RootCheck(true) {
 		return nil
 	}
-	return core.Show()
+	origin, _ := cmd.Flags().GetBool("origin")
+	if err := core.Show(origin); err != nil {
+		return err
+	}
+
+	rules, err := core.LoadPathRules()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("\nManaged paths:")
+	for _, path := range rules.Resolve() {
+		fmt.Println("-", path)
+	}
+
+	if len(rules.Append) > 0 {
+		fmt.Println("\nAppend-only paths:")
+		for _, pattern := range rules.Append {
+			fmt.Println("-", pattern)
+		}
+	}
+
+	if len(rules.Exclude) > 0 {
+		fmt.Println("\nExcluded paths:")
+		for _, pattern := range rules.Exclude {
+			fmt.Println("-", pattern)
+		}
+	}
+
+	return nil
 }
 
 func CmdConfigSet() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "set",
-		Short: "Set a configuration value",
-		RunE:  configSet,
+		Use:          "set",
+		Short:        "Set a configuration value",
+		RunE:         configSet,
+		SilenceUsage: true,
 	}
+	cmd.Flags().Bool("runtime", false, "change the runtime layer")
 	return cmd
 }
 
@@ -62,6 +163,114 @@ func configSet(cmd *cobra.Command, args []string) error {
 	if len(args) < 2 {
 		return fmt.Errorf("missing key or value")
 	}
-	fmt.Println("Setting", args[0], "to", args[1])
-	return core.Set(args[0], args[1])
+
+	key, err := core.LookupKey(args[0])
+	if err != nil {
+		return err
+	}
+	value, err := key.Normalize(args[1])
+	if err != nil {
+		return err
+	}
+
+	if runtime, _ := cmd.Flags().GetBool("runtime"); runtime {
+		fmt.Println("Setting", key.Name, "to", value, "until reboot")
+		return core.SetRuntime(key.Name, value)
+	}
+
+	fmt.Println("Setting", key.Name, "to", value)
+	return core.Set(key.Name, value)
+}
+
+func CmdConfigGet() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "get",
+		Short:        "Show a configuration value",
+		RunE:         configGet,
+		SilenceUsage: true,
+	}
+	return cmd
+}
+
+func configGet(cmd *cobra.Command, args []string) error {
+	if !core.RootCheck(true) {
+		return nil
+	}
+
+	if len(args) < 1 {
+		return fmt.Errorf("missing key")
+	}
+
+	key, err := core.LookupKey(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println(core.GetValue(key.Name))
+	return nil
+}
+
+func CmdConfigUnset() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "unset",
+		Short:        "Remove a configuration value",
+		RunE:         configUnset,
+		SilenceUsage: true,
+	}
+	cmd.Flags().Bool("runtime", false, "change the runtime layer")
+	return cmd
+}
+
+func configUnset(cmd *cobra.Command, args []string) error {
+	if !core.RootCheck(true) {
+		return nil
+	}
+
+	if len(args) < 1 {
+		return fmt.Errorf("missing key")
+	}
+
+	key, err := core.LookupKey(args[0])
+	if err != nil {
+		return err
+	}
+
+	if runtime, _ := cmd.Flags().GetBool("runtime"); runtime {
+		fmt.Println("Removing the runtime override of", key.Name)
+		return core.UnsetRuntime(key.Name)
+	}
+
+	fmt.Println("Removing", key.Name, "from", core.Config)
+	return core.Unset(key.Name)
+}
+
+func CmdConfigDescribe() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "describe",
+		Short:        "Describe the configuration keys",
+		RunE:         configDescribe,
+		SilenceUsage: true,
+	}
+	return cmd
+}
+
+func configDescribe(cmd *cobra.Command, args []string) error {
+	keys := core.Schema
+	if len(args) > 0 {
+		key, err := core.LookupKey(args[0])
+		if err != nil {
+			return err
+		}
+		keys = []core.ConfigKey{key}
+	}
+
+	for i, key := range keys {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(key.Name)
+		fmt.Printf("\t%s\n", key.Description)
+		fmt.Printf("\tType: %s (%s)\n", key.Type, key.Allowed())
+		fmt.Printf("\tDefault: %s\n", key.Default)
+	}
+	return nil
 }
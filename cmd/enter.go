@@ -15,20 +15,34 @@ func enterUsage(*cobra.Command) error {
 	careful when using this command.
 
 Usage:
-	enter [options] [command]
+	enter [options] [command] [paths or groups]
 
 Options:
 	--help/-h		show this message
 	--verbose/-v		verbose output
+	--on-failure [policy]	what to do if some files cannot be processed:
+				keep (default), retry or rollback
+	--retries [n]		number of attempts made by the retry policy
+	--for [duration]	with rw, relock automatically after the given
+				duration, see "almost window"
+	--dry-run		print the files and mounts which would change,
+				without changing anything
 
 Commands:
 	ro			set the filesystem as read-only
 	rw			set the filesystem as read-write
 	default			set the filesystem as defined in the configuration file
 
+	ro and rw act on every managed path unless some managed paths or groups
+	are given.
+
 Examples:
 	almost enter ro
 	almost enter rw
+	almost enter rw /opt
+	almost enter rw --for 15m
+	almost enter ro --on-failure retry
+	almost enter rw /opt --dry-run
 `)
 	return nil
 }
@@ -42,6 +56,10 @@ func NewEnterCommand() *cobra.Command {
 	cmd.SetUsageFunc(enterUsage)
 	cmd.Flags().BoolP("verbose", "v", false, "verbose output")
 	cmd.Flags().BoolP("on-persistent", "p", false, "used by systemd to enter in default mode only if the persistent mode is enabled")
+	cmd.Flags().String("on-failure", "keep", "what to do if some files cannot be processed: keep, retry or rollback")
+	cmd.Flags().Int("retries", 3, "number of attempts made by the retry policy")
+	cmd.Flags().Duration("for", 0, "relock automatically after the given duration")
+	cmd.Flags().Bool("dry-run", false, "print what would change without changing anything")
 	return cmd
 }
 
@@ -56,12 +74,29 @@ func enter(cmd *cobra.Command, args []string) error {
 
 	verbose, _ := cmd.Flags().GetBool("verbose")
 	on_persistent, _ := cmd.Flags().GetBool("on-persistent")
+	onFailure, _ := cmd.Flags().GetString("on-failure")
+	retries, _ := cmd.Flags().GetInt("retries")
+	duration, _ := cmd.Flags().GetDuration("for")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	core.SetDryRun(dryRun)
+
+	policy, err := core.ParseFailurePolicy(onFailure)
+	if err != nil {
+		return err
+	}
+	opts := core.TransitionOptions{
+		Paths:     args[1:],
+		Verbose:   verbose,
+		OnFailure: policy,
+		Retries:   retries,
+		Progress:  newProgress(verbose),
+	}
 
 	switch args[0] {
 	case "ro":
-		return core.EnterRo(verbose)
+		return core.EnterRo(opts)
 	case "rw":
-		if !core.AskConfirmation(`
+		if !dryRun && !askConfirmation(`
 ----------------------
 CONFIRMATION REQUIRED!
 ----------------------
@@ -75,10 +110,23 @@ caused by doing this.
 This command is intended to be used only by advanced users.`) {
 			return nil
 		}
-		return core.EnterRw(verbose)
+		if duration > 0 {
+			return core.OpenWindow(duration, opts)
+		}
+		return core.EnterRw(opts)
 	case "default":
-		return core.EnterDefault(verbose, on_persistent)
+		return core.EnterDefault(opts, on_persistent)
 	default:
 		return fmt.Errorf("unknown command: %s", args[0])
 	}
 }
+
+func askConfirmation(s string) bool {
+	var response string
+	fmt.Print(s + " [y/N]: ")
+	fmt.Scanln(&response)
+	if response == "y" || response == "Y" {
+		return true
+	}
+	return false
+}
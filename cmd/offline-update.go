@@ -17,6 +17,7 @@ Usage:
 
 Options:
 	--help/-h		show this message
+	--dry-run		print what would change without changing anything
 `)
 	return nil
 }
@@ -28,6 +29,7 @@ func NewOfflineUpdateCommand() *cobra.Command {
 		RunE:  offlineUpdate,
 	}
 	cmd.SetUsageFunc(offlineUpdateUsage)
+	cmd.Flags().Bool("dry-run", false, "print what would change without changing anything")
 	return cmd
 }
 
@@ -36,6 +38,9 @@ func offlineUpdate(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	core.SetDryRun(dryRun)
+
 	err := core.OfflineUpdate()
 	if err != nil {
 		return err
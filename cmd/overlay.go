@@ -18,6 +18,10 @@ Usage:
 Options:
 	--help/-h		show this message
 	--verbose/-v		enable verbose output
+	--dry-run		print what would change without changing anything
+	--persist		keep the new overlay mounted across reboots, a
+				systemd mount unit is created and enabled, it is
+				removed on commit or discard
 	
 Commands:
 	new [directory]			Overlay a directory
@@ -27,6 +31,7 @@ Commands:
 
 Examples:
 	almost overlay new /etc/cute-path
+	almost overlay new --persist /etc/cute-path
 	almost overlay commit /etc/cute-path
 	almost overlay discard /etc/cute-path
 	almost overlay list`)
@@ -41,6 +46,8 @@ func NewOverlayCommand() *cobra.Command {
 	}
 	cmd.SetUsageFunc(overlayUsage)
 	cmd.Flags().BoolP("verbose", "v", false, "enable verbose output")
+	cmd.Flags().Bool("dry-run", false, "print what would change without changing anything")
+	cmd.Flags().Bool("persist", false, "keep the new overlay mounted across reboots")
 	return cmd
 }
 
@@ -54,13 +61,16 @@ func overlay(cmd *cobra.Command, args []string) error {
 	}
 
 	verbose, _ := cmd.Flags().GetBool("verbose")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	persist, _ := cmd.Flags().GetBool("persist")
+	core.SetDryRun(dryRun)
 
 	switch args[0] {
 	case "new":
 		if len(args) != 2 {
 			return fmt.Errorf("missing command")
 		}
-		return core.OverlayAdd(args[1], false, verbose)
+		return core.OverlayAdd(args[1], false, persist, verbose)
 	case "commit":
 		if len(args) != 2 {
 			return fmt.Errorf("missing command")
@@ -80,7 +90,10 @@ func overlay(cmd *cobra.Command, args []string) error {
 }
 
 func listOverlays() error {
-	overlays := core.OverlayList()
+	overlays, err := core.OverlayList()
+	if err != nil {
+		return err
+	}
 	count := len(overlays)
 
 	if count == 0 {
@@ -90,8 +103,12 @@ func listOverlays() error {
 
 	fmt.Printf("Found %d overlay(s):\n", count)
 
-	for path, workdir := range overlays {
-		fmt.Printf("%s -> %s\n", path, workdir)
+	for _, overlay := range overlays {
+		lifetime := "until reboot"
+		if overlay.Persist {
+			lifetime = "persistent"
+		}
+		fmt.Printf("%s -> %s (%s)\n", overlay.Path, overlay.WorkDir, lifetime)
 	}
 	return nil
 }
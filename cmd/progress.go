@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vanilla-os/almost/core"
+	"golang.org/x/sys/unix"
+)
+
+// logInterval is how often the progress is logged when not on a TTY
+const logInterval = 5 * time.Second
+
+// newProgress returns the reporter rendering the progress of a transition,
+// a progress bar on a TTY and periodic log lines otherwise, e.g. when run
+// by almost.service. The per-file verbose output would break the progress
+// bar, so log lines are used in verbose mode too.
+func newProgress(verbose bool) core.ProgressReporter {
+	ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ)
+	if err != nil || verbose || ws.Col == 0 {
+		return &logProgress{}
+	}
+	return &barProgress{width: int(ws.Col)}
+}
+
+// barProgress draws a single progress line, redrawn on every update
+type barProgress struct {
+	width int
+}
+
+func (b *barProgress) Start(total int) {}
+
+func (b *barProgress) Update(p core.Progress) {
+	const barWidth = 30
+
+	filled := 0
+	percent := 100
+	if p.Total > 0 {
+		filled = barWidth * p.Done / p.Total
+		percent = 100 * p.Done / p.Total
+	}
+
+	line := fmt.Sprintf("[%s%s] %3d%% %d/%d",
+		strings.Repeat("#", filled), strings.Repeat(".", barWidth-filled), percent, p.Done, p.Total)
+	if p.ETA > 0 {
+		line += " ETA " + p.ETA.Round(time.Second).String()
+	}
+	line += " " + p.Path
+
+	// paths are not ASCII only, the line is cut and padded by runes, as
+	// fmt counts the width
+	if runes := []rune(line); len(runes) > b.width-1 {
+		line = string(runes[:b.width-1])
+	}
+	fmt.Printf("\r%-*s", b.width-1, line)
+}
+
+func (b *barProgress) Finish(p core.Progress) {
+	b.Update(p)
+	fmt.Println()
+}
+
+// logProgress prints a progress line every logInterval
+type logProgress struct {
+	last time.Time
+}
+
+func (l *logProgress) Start(total int) {
+	l.last = time.Now()
+	fmt.Printf("Processing %d file(s)..\n", total)
+}
+
+func (l *logProgress) Update(p core.Progress) {
+	if time.Since(l.last) < logInterval {
+		return
+	}
+	l.last = time.Now()
+
+	line := fmt.Sprintf("Progress: %d/%d file(s)", p.Done, p.Total)
+	if p.ETA > 0 {
+		line += ", ETA " + p.ETA.Round(time.Second).String()
+	}
+	fmt.Printf("%s, current: %s\n", line, p.Path)
+}
+
+func (l *logProgress) Finish(p core.Progress) {
+	fmt.Printf("Processed %d file(s) in %s.\n", p.Total, p.Elapsed.Round(time.Millisecond))
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -51,24 +52,32 @@ func run(cmd *cobra.Command, args []string) error {
 	verbose, _ := cmd.Flags().GetBool("verbose")
 
 	fmt.Println("Running command in read-write mode...")
-	core.EnterRw(verbose)
+	lease, err := core.AcquireLease(strings.Join(args, " "), core.TransitionOptions{Verbose: verbose, OnFailure: core.FailureRollback, Progress: newProgress(verbose)})
+	if err != nil {
+		return err
+	}
 
 	// NOTE: there is a bug when using "almost run", for some reason the
 	// immutability is not fully disabled when the command exits, so we
 	// have to sleep some seconds to make sure
 	time.Sleep(3 * time.Second)
 
+	session := startSession(args)
+
 	c := exec.Command(args[0], args[1:]...)
 	c.Env = os.Environ()
 	c.Stdout = os.Stdout
 	c.Stderr = os.Stderr
 	c.Stdin = os.Stdin
-	err := c.Run()
+	err = c.Run()
 
 	if err != nil {
 		fmt.Println(err)
 	}
 
-	core.EnterRo(verbose)
-	return nil
+	// stopped before relocking, otherwise the attributes changed by almost
+	// would be recorded too
+	stopSession(session)
+
+	return lease.Release(core.TransitionOptions{Verbose: verbose, OnFailure: core.FailureRetry, Progress: newProgress(verbose)})
 }
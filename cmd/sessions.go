@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vanilla-os/almost/core"
+)
+
+func sessionsUsage(*cobra.Command) error {
+	fmt.Print(`Description: 
+	Show the changes made to the managed paths during the read-write sessions
+	started by "almost run" and "almost shell". Reports are stored in
+	/var/log/almost/sessions, auditing can be disabled by setting
+	Almost::SessionAudit to off.
+
+Usage:
+	sessions [options] [command]
+
+Options:
+	--help/-h		show this message
+	--json			print the reports in JSON
+
+Commands:
+	list			list the recorded sessions
+	show [id]		show the changes made during a session
+
+Examples:
+	almost sessions
+	almost sessions show 20221018-153012-4242
+	almost sessions show 20221018-153012-4242 --json
+`)
+	return nil
+}
+
+func NewSessionsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "sessions",
+		Short:        "Show the changes made during the read-write sessions",
+		RunE:         sessions,
+		SilenceUsage: true,
+	}
+	cmd.SetUsageFunc(sessionsUsage)
+	cmd.Flags().Bool("json", false, "print the reports in JSON")
+	return cmd
+}
+
+func sessions(cmd *cobra.Command, args []string) error {
+	if !core.RootCheck(true) {
+		return nil
+	}
+
+	asJson, _ := cmd.Flags().GetBool("json")
+
+	if len(args) == 0 || args[0] == "list" {
+		reports, err := core.ListSessions()
+		if err != nil {
+			return err
+		}
+		if asJson {
+			return printJson(reports)
+		}
+		if len(reports) == 0 {
+			fmt.Println("No sessions recorded.")
+		}
+		for _, report := range reports {
+			fmt.Printf("%s\t%s\t%s\t%d change(s)\t%s\n", report.ID, report.User,
+				report.Start.Format(time.RFC3339), len(report.Events), strings.Join(report.Command, " "))
+		}
+		return nil
+	}
+
+	switch args[0] {
+	case "show":
+		if len(args) != 2 {
+			return fmt.Errorf("missing session ID")
+		}
+		report, err := core.LoadSession(args[1])
+		if err != nil {
+			return err
+		}
+		if asJson {
+			return printJson(report)
+		}
+		printSessionReport(report)
+		return nil
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+func printJson(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printSessionReport(report core.SessionReport) {
+	fmt.Println("Session:", report.ID)
+	fmt.Println("Command:", strings.Join(report.Command, " "))
+	fmt.Println("User:", report.User)
+	fmt.Printf("Time: %s - %s\n", report.Start.Format(time.RFC3339), report.End.Format(time.RFC3339))
+	for _, warning := range report.Warnings {
+		fmt.Println("Warning:", warning)
+	}
+	if report.Overflow {
+		fmt.Println("Warning: some events have been lost, the report is not complete")
+	}
+
+	fmt.Printf("Changes (%d):\n", len(report.Events))
+	for _, event := range report.Events {
+		count := ""
+		if event.Count > 1 {
+			count = fmt.Sprintf(" (x%d)", event.Count)
+		}
+		fmt.Printf("- %s %s %s by %s[%d]%s\n", event.Time.Format("15:04:05"),
+			event.Change, event.Path, event.Comm, event.Pid, count)
+	}
+}
+
+// startSession starts auditing the changes made by the given command,
+// the command runs anyway if the auditing cannot be started
+func startSession(command []string) *core.Session {
+	session, err := core.StartSession(command)
+	if err != nil {
+		fmt.Println("Warning: this session will not be audited:", err)
+	}
+	return session
+}
+
+func stopSession(session *core.Session) {
+	if session == nil {
+		return
+	}
+
+	report, err := session.Stop()
+	if err != nil {
+		fmt.Println("Error saving the session report:", err)
+		return
+	}
+	fmt.Printf("%d change(s) recorded, see: almost sessions show %s\n", len(report.Events), report.ID)
+}
@@ -39,23 +39,34 @@ func shell(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
-	core.EnterRw(false)
+	lease, err := core.AcquireLease("shell", core.TransitionOptions{OnFailure: core.FailureRollback, Progress: newProgress(false)})
+	if err != nil {
+		return err
+	}
 	fmt.Println("\033[33m⚠ WARNING: You are now in read-write mode.")
 	fmt.Println("Any changes you make will be saved to the root filesystem and will persist after you exit.")
 	fmt.Println("Use the `exit` command to return to read-only mode once you are done.\033[0m")
 
+	session := startSession([]string{"su", core.CurrentUser()})
+
 	c := exec.Command("su", core.CurrentUser())
 	c.Stdout = cmd.OutOrStdout()
 	c.Stderr = cmd.OutOrStderr()
 	c.Stdin = cmd.InOrStdin()
-	err := c.Run()
+	err = c.Run()
 
 	if err != nil {
 		fmt.Println(err)
 	}
 
-	core.EnterRo(false)
-	fmt.Println("\033[32m✓ You are now in read-only mode.\033[0m")
+	stopSession(session)
+
+	if err := lease.Release(core.TransitionOptions{OnFailure: core.FailureRetry, Progress: newProgress(false)}); err != nil {
+		return err
+	}
+	if mode, err := core.CurrentMode(); err == nil && mode == core.ModeRo {
+		fmt.Println("\033[32m✓ You are now in read-only mode.\033[0m")
+	}
 
 	return nil
 }
@@ -18,6 +18,8 @@ Usage:
 Options:
 	--help/-h		show this message
 	--verbose/-v		enable verbose output
+	--dry-run		print what would change, including the mount unit,
+				without changing anything
 	
 Commands:
 	new			Create a new state
@@ -37,6 +39,7 @@ func NewStateCommand() *cobra.Command {
 	}
 	cmd.SetUsageFunc(stateUsage)
 	cmd.Flags().BoolP("verbose", "v", false, "enable verbose output")
+	cmd.Flags().Bool("dry-run", false, "print what would change without changing anything")
 	return cmd
 }
 
@@ -50,6 +53,8 @@ func state(cmd *cobra.Command, args []string) error {
 	}
 
 	// verbose, _ := cmd.Flags().GetBool("verbose")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	core.SetDryRun(dryRun)
 
 	switch args[0] {
 	case "new":
@@ -35,6 +35,51 @@ func status(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
+	rules, err := core.LoadPathRules()
+	if err != nil {
+		return err
+	}
+
+	ctx, err := core.NewBackendContext(rules, false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Managed paths:")
+	shown := map[string]bool{}
+	for _, path := range rules.Resolve() {
+		shown[path] = true
+
+		backend, info, err := rules.BackendFor(path, ctx)
+		if err != nil {
+			fmt.Printf("- %s (%s)\n", path, err)
+			continue
+		}
+
+		status := "unlocked"
+		if protected, err := backend.Status(path); err != nil {
+			status = err.Error()
+		} else if protected {
+			status = "locked"
+		}
+
+		switch backend.Name() {
+		case string(core.StrategyChattr):
+			fmt.Printf("- %s on %s: %s, %s, %s when locked\n", path, info.Type, status, backend.Name(), core.AttrNames(rules.LockAttr(path)))
+		case string(core.StrategyBindMount):
+			fmt.Printf("- %s on %s: %s, %s, read-only mount when locked\n", path, info.Type, status, backend.Name())
+		default:
+			fmt.Printf("- %s on %s: not protected\n", path, info.Type)
+		}
+	}
+	// append-only paths nested in another managed path
+	for _, pattern := range rules.Append {
+		if !shown[pattern] {
+			fmt.Printf("- %s (append when locked)\n", pattern)
+		}
+	}
+	fmt.Println()
+
 	states, _, err := core.StateList()
 	if err != nil {
 		return err
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/vanilla-os/almost/core"
+)
+
+func verifyUsage(*cobra.Command) error {
+	fmt.Print(`Description: 
+	Verify that the immutability of the managed paths matches their current
+	mode and report every file which drifted from it.
+
+Usage:
+	verify [options]
+
+Options:
+	--help/-h		show this message
+	--verbose/-v		verbose output
+	--fix			correct the drifted files
+	--json			print a machine-readable report
+	--mode [ro|rw]		verify against the given mode instead of the current one
+	--integrity		report the files added, removed or modified since the
+				last lock, according to the signed manifest
+
+Examples:
+	almost verify
+	almost verify --fix
+	almost verify --json
+	almost verify --integrity
+`)
+	return nil
+}
+
+func NewVerifyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "verify",
+		Short:        "Verify the immutability of the managed paths",
+		RunE:         verify,
+		SilenceUsage: true,
+	}
+	cmd.SetUsageFunc(verifyUsage)
+	cmd.Flags().BoolP("verbose", "v", false, "verbose output")
+	cmd.Flags().Bool("fix", false, "correct the drifted files")
+	cmd.Flags().Bool("json", false, "print a machine-readable report")
+	cmd.Flags().String("mode", "", "verify against the given mode instead of the current one")
+	cmd.Flags().Bool("integrity", false, "report the changes since the last lock")
+	return cmd
+}
+
+func verify(cmd *cobra.Command, args []string) error {
+	if !core.RootCheck(true) {
+		return nil
+	}
+
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	fix, _ := cmd.Flags().GetBool("fix")
+	asJson, _ := cmd.Flags().GetBool("json")
+	modeName, _ := cmd.Flags().GetString("mode")
+	integrity, _ := cmd.Flags().GetBool("integrity")
+
+	if integrity {
+		return verifyIntegrity(asJson)
+	}
+
+	mode := ""
+	if modeName != "" {
+		var err error
+		if mode, err = core.ParseMode(modeName); err != nil {
+			return err
+		}
+	}
+
+	report, err := core.Verify(mode, fix, verbose && !asJson)
+	if err != nil {
+		return err
+	}
+
+	if asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		printVerifyReport(report)
+	}
+
+	unfixed := 0
+	for _, drift := range report.Drifts {
+		if !drift.Fixed {
+			unfixed++
+		}
+	}
+	if unfixed > 0 {
+		return fmt.Errorf("%d file(s) drifted from the current mode", unfixed)
+	}
+	return nil
+}
+
+func printVerifyReport(report core.VerifyReport) {
+	for _, drift := range report.Drifts {
+		switch {
+		case drift.Fixed:
+			fmt.Printf("%s: expected %s, found %s (fixed)\n", drift.Path, drift.Expected, drift.Actual)
+		case drift.Error != "":
+			fmt.Printf("%s: expected %s, found %s (fix failed: %s)\n", drift.Path, drift.Expected, drift.Actual, drift.Error)
+		default:
+			fmt.Printf("%s: expected %s, found %s\n", drift.Path, drift.Expected, drift.Actual)
+		}
+	}
+
+	for _, failure := range report.Failures {
+		fmt.Println("Error:", failure)
+	}
+
+	fmt.Printf("%d file(s) checked, %d skipped, %d drifted, %d error(s).\n",
+		report.Checked, report.Skipped, len(report.Drifts), len(report.Failures))
+}
+
+func verifyIntegrity(asJson bool) error {
+	report, err := core.VerifyIntegrity()
+	if err != nil {
+		return err
+	}
+
+	if asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		if !report.SignatureValid {
+			fmt.Println("Warning: the manifest signature is not valid, the manifest may have been tampered with")
+		}
+		for _, path := range report.Added {
+			fmt.Println("added:", path)
+		}
+		for _, path := range report.Removed {
+			fmt.Println("removed:", path)
+		}
+		for _, path := range report.Modified {
+			fmt.Println("modified:", path)
+		}
+		for _, failure := range report.Failures {
+			fmt.Println("Error:", failure)
+		}
+		fmt.Printf("%d added, %d removed, %d modified, %d error(s).\n",
+			len(report.Added), len(report.Removed), len(report.Modified), len(report.Failures))
+	}
+
+	if !report.Clean() {
+		return fmt.Errorf("the managed paths do not match the manifest")
+	}
+	return nil
+}
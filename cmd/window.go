@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vanilla-os/almost/core"
+)
+
+func windowUsage(*cobra.Command) error {
+	fmt.Print(`Description: 
+	Manage the time-limited read-write window opened with "almost enter rw --for".
+
+Usage:
+	window [options] [command]
+
+Options:
+	--help/-h		show this message
+	--verbose/-v		verbose output
+	--relock		lock the system right away when cancelling
+
+Commands:
+	status			show the remaining time of the window
+	extend [duration]	postpone the relock by the given duration
+	cancel			cancel the automatic relock
+
+Examples:
+	almost window
+	almost window extend 10m
+	almost window cancel --relock
+`)
+	return nil
+}
+
+func NewWindowCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "window",
+		Short: "Manage the time-limited read-write window",
+		RunE:  window,
+	}
+	cmd.SetUsageFunc(windowUsage)
+	cmd.Flags().BoolP("verbose", "v", false, "verbose output")
+	cmd.Flags().Bool("relock", false, "lock the system right away when cancelling")
+	return cmd
+}
+
+func window(cmd *cobra.Command, args []string) error {
+	if !core.RootCheck(true) {
+		return nil
+	}
+
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	relock, _ := cmd.Flags().GetBool("relock")
+	opts := core.TransitionOptions{Verbose: verbose, OnFailure: core.FailureRetry, Progress: newProgress(verbose)}
+
+	if len(args) == 0 {
+		return windowStatus()
+	}
+
+	switch args[0] {
+	case "status":
+		return windowStatus()
+	case "extend":
+		if len(args) != 2 {
+			return fmt.Errorf("missing duration")
+		}
+		duration, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		return core.ExtendWindow(duration)
+	case "cancel":
+		return core.CancelWindow(relock, opts)
+	case "expire":
+		// used by the relock timer
+		return core.ExpireWindow(opts)
+	case "supervise":
+		// used when no relock timer can be created
+		return core.SuperviseWindow(opts)
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+func windowStatus() error {
+	w, err := core.CurrentWindow()
+	if err != nil {
+		return err
+	}
+
+	if w == nil {
+		fmt.Println("No read-write window is open.")
+		return nil
+	}
+
+	fmt.Printf("Read-write window: %s remaining (relocks at %s)\n",
+		w.Remaining().Round(time.Second), w.Expires.Format(time.Kitchen))
+	if len(w.Paths) > 0 {
+		fmt.Println("Paths:")
+		for _, path := range w.Paths {
+			fmt.Println("-", path)
+		}
+	}
+	return nil
+}
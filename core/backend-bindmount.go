@@ -0,0 +1,287 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindMountBackend protects the managed paths with read-only bind mounts,
+// without touching the on-disk inode flags. The mounts made by almost are
+// tracked in the mode state so that mounts made by others are never
+// released.
+type bindMountBackend struct {
+	ctx     *BackendContext
+	mounted []string
+	// lock tells whether the mounts have been applied or released, to
+	// undo the right operation on rollback
+	lock bool
+}
+
+func newBindMountBackend(ctx *BackendContext) *bindMountBackend {
+	return &bindMountBackend{ctx: ctx}
+}
+
+func (b *bindMountBackend) Name() string {
+	return string(StrategyBindMount)
+}
+
+func (b *bindMountBackend) Lock(path string) WalkSummary {
+	b.ctx.progress.step(path)
+	// the target system mounts the path when entering its default mode
+	// at boot
+	if rootDir != "" {
+		logf("Skipping the read-only bind mount of %s, it is made on boot\n", path)
+		return WalkSummary{Skipped: 1}
+	}
+	if dryRun {
+		if protected, _ := b.Status(path); protected {
+			return WalkSummary{Unchanged: 1}
+		}
+		logf("Would mount %s read-only (bind mount)\n", path)
+		return WalkSummary{Changed: 1}
+	}
+
+	b.lock = true
+	return b.summarize(path, bindMountRo(path, b.ctx.State), "applied")
+}
+
+func (b *bindMountBackend) Unlock(path string) WalkSummary {
+	b.ctx.progress.step(path)
+	if rootDir != "" {
+		return WalkSummary{Skipped: 1}
+	}
+	if dryRun {
+		if !b.ctx.State.Mounts[path] {
+			return WalkSummary{Unchanged: 1}
+		}
+		logf("Would unmount the read-only bind mount on %s\n", path)
+		return WalkSummary{Changed: 1}
+	}
+
+	b.lock = false
+	return b.summarize(path, bindMountRelease(path, b.ctx.State), "released")
+}
+
+func (b *bindMountBackend) Status(path string) (bool, error) {
+	ro, _ := topMountReadOnly(path)
+	return b.ctx.State.Mounts[path] && ro, nil
+}
+
+func (b *bindMountBackend) Verify(path string, mode string, fix bool) ([]Drift, WalkSummary) {
+	summary := WalkSummary{Unchanged: 1}
+
+	protected, _ := b.Status(path)
+	if protected == (mode == ModeRo) {
+		return nil, summary
+	}
+
+	drift := Drift{Path: path, Expected: "ro-mount", Actual: "none"}
+	if protected {
+		drift.Expected, drift.Actual = "none", "ro-mount"
+	}
+
+	if fix {
+		var err error
+		if mode == ModeRo {
+			err = bindMountRo(path, b.ctx.State)
+		} else {
+			err = bindMountRelease(path, b.ctx.State)
+		}
+
+		if err != nil {
+			drift.Error = err.Error()
+		} else {
+			drift.Fixed = true
+		}
+	}
+
+	return []Drift{drift}, WalkSummary{Changed: 1}
+}
+
+func (b *bindMountBackend) Rollback() []FileError {
+	failures := []FileError{}
+
+	for _, path := range b.mounted {
+		var err error
+		if b.lock {
+			err = bindMountRelease(path, b.ctx.State)
+		} else {
+			err = bindMountRo(path, b.ctx.State)
+		}
+		if err != nil {
+			failures = append(failures, FileError{Path: path, Err: err})
+		}
+	}
+
+	return failures
+}
+
+func (b *bindMountBackend) summarize(path string, err error, action string) WalkSummary {
+	var summary WalkSummary
+
+	if err != nil {
+		summary.fail(path, err)
+		return summary
+	}
+
+	summary.Changed++
+	b.mounted = append(b.mounted, path)
+	if b.ctx.Verbose {
+		logf("%s: read-only bind mount %s\n", path, action)
+	}
+
+	return summary
+}
+
+/*
+bindMountRo protects a path by bind mounting it on itself, with the mounts
+below it, and making the bind mounts read-only with mount_setattr, falling
+back to remounts on kernels older than 5.12. If the path is already
+protected this way it is left as is.
+*/
+func bindMountRo(path string, state *ModeState) error {
+	if state.Mounts[path] {
+		if ro, found := topMountReadOnly(path); found && ro {
+			return nil
+		}
+	}
+
+	// a plain bind mount would hide the mounts below the path, e.g.
+	// /boot/efi when protecting /boot
+	if err := unix.Mount(path, path, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return err
+	}
+
+	err := unix.MountSetattr(unix.AT_FDCWD, path, unix.AT_RECURSIVE, &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY})
+	if errors.Is(err, unix.ENOSYS) {
+		err = remountTreeRo(path)
+	}
+	if err != nil {
+		unix.Unmount(path, unix.MNT_DETACH)
+		return err
+	}
+
+	if state.Mounts == nil {
+		state.Mounts = map[string]bool{}
+	}
+	state.Mounts[path] = true
+	return nil
+}
+
+/*
+bindMountRelease removes the read-only bind mount created by bindMountRo,
+only mounts created by almost are touched. If another mount has been made
+on top of it, the release fails and the mount stays tracked.
+*/
+func bindMountRelease(path string, state *ModeState) error {
+	if !state.Mounts[path] {
+		return nil
+	}
+
+	ro, found := topMountReadOnly(path)
+	if found && !ro {
+		return fmt.Errorf("the read-only bind mount on %s is covered by another mount, unmount it first", path)
+	}
+	// detaching takes the bind mounts of the mounts below along
+	if found {
+		if err := unix.Unmount(path, unix.MNT_DETACH); err != nil {
+			return err
+		}
+	}
+
+	delete(state.Mounts, path)
+	return nil
+}
+
+// remountTreeRo makes the bind mounts of a path and of the mounts below it
+// read-only one by one
+func remountTreeRo(path string) error {
+	for _, mountPoint := range append([]string{path}, mountsBelow(path)...) {
+		if err := unix.Mount("", mountPoint, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountsBelow returns the mount points found below the given path
+func mountsBelow(path string) []string {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	seen := map[string]bool{}
+	mountPoints := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mountPoint := unescapeMountPath(fields[4])
+		if mountPoint != path && isSubPath(path, mountPoint) && !seen[mountPoint] {
+			seen[mountPoint] = true
+			mountPoints = append(mountPoints, mountPoint)
+		}
+	}
+
+	return mountPoints
+}
+
+// topMountReadOnly checks whether the last mount made on the given path is
+// read-only
+func topMountReadOnly(path string) (bool, bool) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, false
+	}
+	defer f.Close()
+
+	ro, found := false, false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// id parent major:minor root mountpoint options ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || unescapeMountPath(fields[4]) != path {
+			continue
+		}
+
+		found = true
+		ro = false
+		for _, option := range strings.Split(fields[5], ",") {
+			if option == "ro" {
+				ro = true
+			}
+		}
+	}
+
+	return ro, found
+}
+
+// unescapeMountPath decodes the octal escapes used in mountinfo
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, "\\") {
+		return path
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,196 @@
+package core
+
+import (
+	"io/fs"
+)
+
+// journalEntry holds what is needed to undo the change made to a file
+type journalEntry struct {
+	mask  int32
+	attrs int32
+}
+
+// chattrBackend protects the managed paths by setting the immutable (or
+// append-only) flag on every file, keeping track of what has been changed
+// so that it can be rolled back.
+type chattrBackend struct {
+	ctx     *BackendContext
+	roots   []string
+	journal map[string]journalEntry
+}
+
+func newChattrBackend(ctx *BackendContext) *chattrBackend {
+	return &chattrBackend{
+		ctx:     ctx,
+		roots:   ctx.Rules.Resolve(),
+		journal: map[string]journalEntry{},
+	}
+}
+
+func (b *chattrBackend) Name() string {
+	return string(StrategyChattr)
+}
+
+func (b *chattrBackend) Lock(path string) WalkSummary {
+	return b.walk(path, true, false)
+}
+
+func (b *chattrBackend) Unlock(path string) WalkSummary {
+	// the attributes are recorded only for paths which are not unlocked
+	// yet, otherwise the unlocked state would be recorded
+	record := b.ctx.Record != nil && b.ctx.State.ModeOf(rootOf(b.roots, path)) != ModeRw
+
+	return b.walk(path, false, record)
+}
+
+func (b *chattrBackend) Status(path string) (bool, error) {
+	attrs, err := GetPathAttrs(path)
+	if err != nil {
+		return false, err
+	}
+
+	return attrs&inventoryMask != 0, nil
+}
+
+func (b *chattrBackend) Verify(path string, mode string, fix bool) ([]Drift, WalkSummary) {
+	lock := mode == ModeRo
+	drifts := []Drift{}
+
+	summary, err := Walk(path, b.ctx.Walk, func(file string, d fs.DirEntry) (bool, error) {
+		attrs, err := GetPathAttrs(file)
+		if err != nil {
+			return false, err
+		}
+
+		mask, want := b.target(file, lock)
+		if attrs&mask == want&mask {
+			return false, nil
+		}
+
+		drift := Drift{
+			Path:     file,
+			Expected: AttrNames(want & mask),
+			Actual:   AttrNames(attrs & mask),
+		}
+		if fix {
+			if _, err := b.apply(file, lock, false); err != nil {
+				drift.Error = err.Error()
+			} else {
+				drift.Fixed = true
+			}
+		}
+		drifts = append(drifts, drift)
+
+		return true, nil
+	})
+	if err != nil {
+		summary.fail(path, err)
+	}
+
+	return drifts, summary
+}
+
+func (b *chattrBackend) Rollback() []FileError {
+	failures := []FileError{}
+
+	for file, entry := range b.journal {
+		if _, _, err := applyFileAttrs(file, entry.mask, entry.attrs); err != nil {
+			failures = append(failures, FileError{Path: file, Err: err})
+		}
+	}
+
+	return failures
+}
+
+func (b *chattrBackend) walk(path string, lock bool, record bool) WalkSummary {
+	summary, err := Walk(path, b.ctx.Walk, func(file string, d fs.DirEntry) (bool, error) {
+		b.ctx.progress.step(file)
+		return b.apply(file, lock, record)
+	})
+	if err != nil {
+		summary.fail(path, err)
+	}
+
+	if b.ctx.Verbose {
+		logf("%s: %d changed, %d unchanged, %d skipped, %d failed\n",
+			path, summary.Changed, summary.Unchanged, summary.Skipped, summary.Failed)
+	}
+
+	return summary
+}
+
+// target returns the attributes to change on a file and their value
+func (b *chattrBackend) target(file string, lock bool) (int32, int32) {
+	if !lock {
+		return inventoryMask, 0
+	}
+
+	if attrs, ok := b.ctx.Restore[file]; ok {
+		return inventoryMask, attrs
+	}
+	return inventoryMask, b.ctx.Rules.LockAttr(file)
+}
+
+func (b *chattrBackend) apply(file string, lock bool, record bool) (bool, error) {
+	if lock && b.ctx.Visited != nil {
+		b.ctx.Visited[file] = true
+	}
+
+	mask, want := b.target(file, lock)
+	if dryRun {
+		return previewFileAttrs(file, mask, want)
+	}
+
+	prev, changed, err := applyFileAttrs(file, mask, want)
+	if err != nil {
+		if b.ctx.Verbose {
+			logf("Error processing %s: %s\n", file, err.Error())
+		}
+		return false, err
+	}
+
+	if record {
+		if _, ok := b.ctx.Record[file]; !ok {
+			b.ctx.Record[file] = prev & inventoryMask
+		}
+	}
+	if changed {
+		if _, ok := b.journal[file]; !ok {
+			b.journal[file] = journalEntry{mask: mask, attrs: prev}
+		}
+	}
+
+	return changed, nil
+}
+
+// applyFileAttrs applies the attributes to a single file, it returns the
+// attributes the file had and whether they changed.
+func applyFileAttrs(file string, mask int32, want int32) (int32, bool, error) {
+	fi, err := OpenAttrFile(file)
+	if err != nil {
+		return 0, false, err
+	}
+	defer fi.Close()
+
+	return ApplyAttrs(fi, mask, want)
+}
+
+// previewFileAttrs prints the attributes applyFileAttrs would change
+func previewFileAttrs(file string, mask int32, want int32) (bool, error) {
+	attrs, err := GetPathAttrs(file)
+	if err != nil {
+		return false, err
+	}
+	if attrs&mask == want&mask {
+		return false, nil
+	}
+
+	logf("%s: %s -> %s\n", file, AttrNames(attrs&mask), AttrNames(want&mask))
+	return true, nil
+}
+
+// GetImmutableFlag reports whether the immutable flag is set on the given
+// path itself, directories are not expanded.
+func GetImmutableFlag(path string) (bool, error) {
+	return IsPathAttr(path, FS_IMMUTABLE_FL)
+}
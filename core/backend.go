@@ -0,0 +1,194 @@
+package core
+
+import (
+	"time"
+)
+
+/*
+Backend protects the managed paths while the system is locked. The backend
+of a path is the one set in Almost::Backend, unless the path policy or the
+capabilities of its file system require another one, see StrategyFor.
+*/
+type Backend interface {
+	// Name returns the name of the backend, as used in the configuration
+	Name() string
+	// Lock protects the given path, a managed path or a file below it
+	Lock(path string) WalkSummary
+	// Unlock makes the given path writable, a managed path or a file
+	// below it
+	Unlock(path string) WalkSummary
+	// Status reports whether the given managed path is protected
+	Status(path string) (bool, error)
+	// Verify reports what does not match the given mode in the given
+	// managed path, correcting it if fix is set
+	Verify(path string, mode string, fix bool) ([]Drift, WalkSummary)
+	// Rollback undoes every change made by Lock and Unlock
+	Rollback() []FileError
+}
+
+/*
+BackendContext holds what the backends need to process the managed paths.
+*/
+type BackendContext struct {
+	Rules   PathRules
+	Walk    WalkOptions
+	State   *ModeState
+	Verbose bool
+	// Restore holds the attributes files must have when locked
+	Restore Inventory
+	// Record collects the attributes files had before being unlocked, if
+	// not nil
+	Record Inventory
+	// Visited collects the files the lock went through, if not nil
+	Visited map[string]bool
+
+	progress *progressTracker
+}
+
+/*
+NewBackendContext prepares a context with the current state of the
+managed paths.
+*/
+func NewBackendContext(rules PathRules, verbose bool) (*BackendContext, error) {
+	state, err := LoadModeState()
+	if err != nil {
+		return nil, err
+	}
+
+	restore, err := LoadLockedAttrs()
+	if err != nil {
+		return nil, err
+	}
+
+	return &BackendContext{
+		Rules:   rules,
+		Walk:    rules.WalkOptions(),
+		State:   &state,
+		Verbose: verbose,
+		Restore: restore,
+	}, nil
+}
+
+/*
+NewBackend returns the backend implementing the given strategy.
+*/
+func NewBackend(strategy Strategy, ctx *BackendContext) Backend {
+	switch strategy {
+	case StrategyBindMount:
+		return newBindMountBackend(ctx)
+	case StrategyNone:
+		return noneBackend{}
+	default:
+		return newChattrBackend(ctx)
+	}
+}
+
+/*
+BackendFor returns the backend protecting the given managed path.
+*/
+func (r PathRules) BackendFor(path string, ctx *BackendContext) (Backend, FsInfo, error) {
+	strategy, info, err := r.StrategyFor(path)
+	if err != nil {
+		return nil, info, err
+	}
+
+	return NewBackend(strategy, ctx), info, nil
+}
+
+// noneBackend is used for paths which cannot be protected
+type noneBackend struct{}
+
+func (noneBackend) Name() string                     { return string(StrategyNone) }
+func (noneBackend) Lock(path string) WalkSummary     { return WalkSummary{Skipped: 1} }
+func (noneBackend) Unlock(path string) WalkSummary   { return WalkSummary{Skipped: 1} }
+func (noneBackend) Status(path string) (bool, error) { return false, nil }
+func (noneBackend) Rollback() []FileError            { return nil }
+
+func (noneBackend) Verify(path string, mode string, fix bool) ([]Drift, WalkSummary) {
+	return nil, WalkSummary{Skipped: 1}
+}
+
+// transition applies a mode change to the managed paths, dispatching each
+// one to its backend
+type transition struct {
+	lock     bool
+	ctx      *BackendContext
+	roots    []string
+	backends map[string]Backend
+}
+
+func newTransition(lock bool, ctx *BackendContext) *transition {
+	return &transition{
+		lock:     lock,
+		ctx:      ctx,
+		backends: map[string]Backend{},
+	}
+}
+
+// add registers a managed path with the backend protecting it
+func (t *transition) add(root string, strategy Strategy) {
+	// backends are shared between the paths using the same strategy, so
+	// that a single rollback undoes everything
+	for _, backend := range t.backends {
+		if backend.Name() == string(strategy) {
+			t.backends[root] = backend
+			t.roots = append(t.roots, root)
+			return
+		}
+	}
+
+	t.backends[root] = NewBackend(strategy, t.ctx)
+	t.roots = append(t.roots, root)
+}
+
+func (t *transition) run(path string) WalkSummary {
+	backend := t.backends[rootOf(t.roots, path)]
+	if backend == nil {
+		t.ctx.progress.step(path)
+		return WalkSummary{Skipped: 1}
+	}
+	if backend.Name() == string(StrategyNone) {
+		t.ctx.progress.step(path)
+	}
+
+	if t.lock {
+		return backend.Lock(path)
+	}
+	return backend.Unlock(path)
+}
+
+// retry processes the failed files again, up to the given number of
+// attempts, and returns the files which are still failing
+func (t *transition) retry(failures []FileError, attempts int) []FileError {
+	if attempts <= 0 {
+		attempts = 3
+	}
+
+	for i := 1; i <= attempts && len(failures) > 0; i++ {
+		logf("Retrying %d failed file(s) (attempt %d/%d)..\n", len(failures), i, attempts)
+		time.Sleep(500 * time.Millisecond)
+
+		var summary WalkSummary
+		for _, failure := range failures {
+			summary.Add(t.run(failure.Path))
+		}
+		failures = summary.Failures
+	}
+
+	return failures
+}
+
+// rollback undoes the changes made by every backend
+func (t *transition) rollback() []FileError {
+	failures := []FileError{}
+
+	done := map[Backend]bool{}
+	for _, backend := range t.backends {
+		if !done[backend] {
+			done[backend] = true
+			failures = append(failures, backend.Rollback()...)
+		}
+	}
+
+	return failures
+}
@@ -6,10 +6,15 @@ Credits to :
 package core
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
-	"os/exec"
+	"strings"
 	"syscall"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 /*
@@ -38,24 +43,141 @@ const (
 	FS_TOPDIR_FL       = 0x00020000 /* Top of directory hierarchies*/
 	FS_HUGE_FILE_FL    = 0x00040000 /* Reserved for ext4 */
 	FS_EXTENT_FL       = 0x00080000 /* Extents */
+	FS_VERITY_FL       = 0x00100000 /* Verity protected inode */
 	FS_EA_INODE_FL     = 0x00200000 /* Inode used for large EA */
 	FS_EOFBLOCKS_FL    = 0x00400000 /* Reserved for ext4 */
 	FS_NOCOW_FL        = 0x00800000 /* Do not cow file */
+	FS_DAX_FL          = 0x02000000 /* Inode is DAX */
 	FS_INLINE_DATA_FL  = 0x10000000 /* Reserved for ext4 */
 	FS_PROJINHERIT_FL  = 0x20000000 /* Create with parents projid */
+	FS_CASEFOLD_FL     = 0x40000000 /* Folder is case insensitive */
 	FS_RESERVED_FL     = 0x80000000 /* reserved for ext2 lib */
 
 )
 
+/*
+AttrFlag associates a file attribute with its symbolic name and the letter
+used by chattr and lsattr.
+*/
+type AttrFlag struct {
+	Name   string
+	Letter byte
+	Flag   int32
+}
+
+/*
+AttrFlags lists the known file attributes, in the order used by lsattr.
+*/
+var AttrFlags = []AttrFlag{
+	{"secrm", 's', FS_SECRM_FL},
+	{"unrm", 'u', FS_UNRM_FL},
+	{"sync", 'S', FS_SYNC_FL},
+	{"dirsync", 'D', FS_DIRSYNC_FL},
+	{"immutable", 'i', FS_IMMUTABLE_FL},
+	{"append", 'a', FS_APPEND_FL},
+	{"nodump", 'd', FS_NODUMP_FL},
+	{"noatime", 'A', FS_NOATIME_FL},
+	{"compress", 'c', FS_COMPR_FL},
+	{"encrypt", 'E', FS_ENCRYPT_FL},
+	{"journal", 'j', FS_JOURNAL_DATA_FL},
+	{"index", 'I', FS_INDEX_FL},
+	{"notail", 't', FS_NOTAIL_FL},
+	{"topdir", 'T', FS_TOPDIR_FL},
+	{"extent", 'e', FS_EXTENT_FL},
+	{"nocow", 'C', FS_NOCOW_FL},
+	{"dax", 'x', FS_DAX_FL},
+	{"casefold", 'F', FS_CASEFOLD_FL},
+	{"inline", 'N', FS_INLINE_DATA_FL},
+	{"projinherit", 'P', FS_PROJINHERIT_FL},
+	{"verity", 'V', FS_VERITY_FL},
+	{"nocomp", 'm', FS_NOCOMP_FL},
+}
+
+/*
+ParseAttrs converts a list of attribute names into the attributes mask,
+single chattr letters are accepted too.
+*/
+func ParseAttrs(names []string) (int32, error) {
+	var attrs int32
+
+	for _, name := range names {
+		found := false
+		for _, flag := range AttrFlags {
+			if name == flag.Name || (len(name) == 1 && name[0] == flag.Letter) {
+				attrs |= flag.Flag
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown attribute %s", name)
+		}
+	}
+
+	return attrs, nil
+}
+
+/*
+FormatAttrs returns the lsattr representation of the attributes, one
+letter or dash for every known attribute.
+*/
+func FormatAttrs(attrs int32) string {
+	var sb strings.Builder
+
+	for _, flag := range AttrFlags {
+		if attrs&flag.Flag != 0 {
+			sb.WriteByte(flag.Letter)
+		} else {
+			sb.WriteByte('-')
+		}
+	}
+
+	return sb.String()
+}
+
+/*
+AttrFlagNames returns the names of the known attributes set in attrs.
+*/
+func AttrFlagNames(attrs int32) []string {
+	names := []string{}
+
+	for _, flag := range AttrFlags {
+		if attrs&flag.Flag != 0 {
+			names = append(names, flag.Name)
+		}
+	}
+
+	return names
+}
+
 /*
 Request flags.
 */
 const (
-	// from ioctl_list manpage
-	FS_IOC_GETFLAGS uintptr = 0x80086601
-	FS_IOC_SETFLAGS uintptr = 0x40086602
+	// the request numbers encode sizeof(long), so they differ between 32-bit
+	// and 64-bit architectures, x/sys/unix provides the right ones for the
+	// architecture we are built for
+	FS_IOC_GETFLAGS uintptr = unix.FS_IOC_GETFLAGS
+	FS_IOC_SETFLAGS uintptr = unix.FS_IOC_SETFLAGS
 )
 
+/*
+AttrState holds the attributes of a path, or the error occurred while
+reading them.
+*/
+type AttrState struct {
+	Path  string
+	Attrs int32
+	Err   error
+}
+
+/*
+Has checks whether the given attribute is set in the state.
+*/
+func (s AttrState) Has(attr int32) bool {
+	return s.Err == nil && (s.Attrs&attr) != 0
+}
+
 func ioctl(f *os.File, request uintptr, attrp *int32) error {
 
 	argp := uintptr(unsafe.Pointer(attrp))
@@ -134,18 +256,205 @@ func IsAttr(f *os.File, attr int32) (bool, error) {
 }
 
 /*
-Legacy functions using the chattr utility.
+ApplyAttrs changes the attributes selected by mask so that they match want,
+leaving the others untouched. It returns the attributes the file had before
+and whether they have been changed.
 */
-func LegacySetAttr(path string, attr string) error {
+func ApplyAttrs(f *os.File, mask int32, want int32) (int32, bool, error) {
+
+	attrs, err := GetAttrs(f)
+
+	if err != nil {
+		return attrs, false, err
+	}
+
+	newAttrs := (attrs &^ mask) | (want & mask)
+	if newAttrs == attrs {
+		return attrs, false, nil
+	}
+
+	err = ioctl(f, FS_IOC_SETFLAGS, &newAttrs)
+
+	return attrs, err == nil, err
+}
 
-	cmd := exec.Command("chattr", "+"+attr, path)
+/*
+OpenAttrFile opens a path so that its attributes can be read or changed,
+symlinks are not followed and opening device nodes or fifos has no side
+effects.
+*/
+func OpenAttrFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW|syscall.O_NOCTTY, 0)
+}
 
-	return cmd.Run()
+/*
+GetPathAttrs retrieves the attributes of the file at the given path.
+*/
+func GetPathAttrs(path string) (int32, error) {
+	f, err := OpenAttrFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return GetAttrs(f)
+}
+
+/*
+IsPathAttr checks whether the given attribute is set on the file at the
+given path.
+*/
+func IsPathAttr(path string, attr int32) (bool, error) {
+	attrs, err := GetPathAttrs(path)
+	if err != nil {
+		return false, err
+	}
+
+	return (attrs & attr) != 0, nil
+}
+
+/*
+QueryAttrs retrieves the attributes of every given path, a failure on one
+path is reported in its state and does not stop the others.
+*/
+func QueryAttrs(paths ...string) []AttrState {
+	states := make([]AttrState, 0, len(paths))
+
+	for _, path := range paths {
+		attrs, err := GetPathAttrs(path)
+		states = append(states, AttrState{Path: path, Attrs: attrs, Err: err})
+	}
+
+	return states
+}
+
+/*
+ChangePathAttrs sets and unsets the given attributes on path, and on its
+whole content if recursive is set. The path is resolved below the
+alternate root, if any.
+*/
+func ChangePathAttrs(path string, set int32, unset int32, recursive bool) (WalkSummary, error) {
+	unlock, err := LockOperation()
+	if err != nil {
+		return WalkSummary{}, err
+	}
+	defer unlock()
+
+	opts, err := attrWalkOptions(rooted(path), recursive)
+	if errors.Is(err, errSymlinkAttrs) {
+		summary := WalkSummary{}
+		summary.fail(path, err)
+		return summary, nil
+	}
+	if err != nil {
+		return WalkSummary{}, err
+	}
+
+	summary, err := Walk(rooted(path), opts, func(file string, d fs.DirEntry) (bool, error) {
+		f, err := OpenAttrFile(file)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+
+		_, changed, err := ApplyAttrs(f, set|unset, set)
+		return changed, err
+	})
+	for i := range summary.Failures {
+		summary.Failures[i].Path = unrooted(summary.Failures[i].Path)
+	}
+
+	return summary, err
+}
+
+/*
+QueryPathAttrs retrieves the attributes of path, and of its whole content
+if recursive is set. The path is resolved below the alternate root, if
+any.
+*/
+func QueryPathAttrs(path string, recursive bool) ([]AttrState, error) {
+	states := []AttrState{}
+
+	opts, err := attrWalkOptions(rooted(path), recursive)
+	if errors.Is(err, errSymlinkAttrs) {
+		return append(states, AttrState{Path: path, Err: err}), nil
+	}
+	if err != nil {
+		return states, err
+	}
+
+	summary, err := Walk(rooted(path), opts, func(file string, d fs.DirEntry) (bool, error) {
+		states = append(states, QueryAttrs(file)...)
+		return false, nil
+	})
+	for _, failure := range summary.Failures {
+		states = append(states, AttrState{Path: failure.Path, Err: failure.Err})
+	}
+	for i := range states {
+		states[i].Path = unrooted(states[i].Path)
+	}
+
+	return states, err
+}
+
+// errSymlinkAttrs is reported for a symlink named explicitly, like lsattr
+// does, since it has no attributes of its own
+var errSymlinkAttrs = fmt.Errorf("symlinks have no attributes: %w", unix.EOPNOTSUPP)
+
+// attrWalkOptions returns the options walking the path named explicitly,
+// which is processed whatever its type: opening a device node or a fifo has
+// no side effects with OpenAttrFile
+func attrWalkOptions(root string, recursive bool) (WalkOptions, error) {
+	opts := WalkOptions{}
+	if recursive {
+		opts.MaxDepth = -1
+	}
+
+	info, err := os.Lstat(root)
+	if err != nil {
+		return opts, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return opts, errSymlinkAttrs
+	}
+	opts.Special = !info.IsDir()
+
+	return opts, nil
+}
+
+/*
+Legacy functions taking chattr letters, e.g. "i" or "ia". They used to
+run the chattr utility and are kept for compatibility.
+*/
+func LegacySetAttr(path string, attr string) error {
+	return legacyChangeAttr(path, attr, true)
 }
 
 func LegacyUnsetAttr(path string, attr string) error {
+	return legacyChangeAttr(path, attr, false)
+}
 
-	cmd := exec.Command("chattr", "-"+attr, path)
+func legacyChangeAttr(path string, letters string, set bool) error {
+	names := make([]string, 0, len(letters))
+	for _, letter := range letters {
+		names = append(names, string(letter))
+	}
 
-	return cmd.Run()
+	attrs, err := ParseAttrs(names)
+	if err != nil {
+		return err
+	}
+
+	f, err := OpenAttrFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if set {
+		_, _, err = ApplyAttrs(f, attrs, attrs)
+	} else {
+		_, _, err = ApplyAttrs(f, attrs, 0)
+	}
+	return err
 }
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseAttrs(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  int32
+		fails bool
+	}{
+		{names: nil, want: 0},
+		{names: []string{"immutable"}, want: FS_IMMUTABLE_FL},
+		{names: []string{"i"}, want: FS_IMMUTABLE_FL},
+		{names: []string{"immutable", "a"}, want: FS_IMMUTABLE_FL | FS_APPEND_FL},
+		{names: []string{"i", "i"}, want: FS_IMMUTABLE_FL},
+		// the letters are case sensitive, as with chattr
+		{names: []string{"A"}, want: FS_NOATIME_FL},
+		{names: []string{"S"}, want: FS_SYNC_FL},
+		{names: []string{"s"}, want: FS_SECRM_FL},
+		{names: []string{"Immutable"}, fails: true},
+		{names: []string{"ia"}, fails: true},
+		{names: []string{"z"}, fails: true},
+		{names: []string{""}, fails: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseAttrs(test.names)
+		switch {
+		case test.fails && err == nil:
+			t.Errorf("ParseAttrs(%q) = %#x, want an error", test.names, got)
+		case !test.fails && err != nil:
+			t.Errorf("ParseAttrs(%q): %s", test.names, err)
+		case !test.fails && got != test.want:
+			t.Errorf("ParseAttrs(%q) = %#x, want %#x", test.names, got, test.want)
+		}
+	}
+}
+
+func TestFormatAttrs(t *testing.T) {
+	tests := []struct {
+		attrs int32
+		want  string
+	}{
+		{0, "----------------------"},
+		{FS_IMMUTABLE_FL, "----i-----------------"},
+		{FS_IMMUTABLE_FL | FS_APPEND_FL | FS_EXTENT_FL, "----ia--------e-------"},
+		{FS_SECRM_FL | FS_NOCOMP_FL, "s--------------------m"},
+		// unknown attributes are not shown
+		{FS_DIRTY_FL | FS_HUGE_FILE_FL, "----------------------"},
+	}
+
+	for _, test := range tests {
+		if got := FormatAttrs(test.attrs); got != test.want {
+			t.Errorf("FormatAttrs(%#x) = %q, want %q", test.attrs, got, test.want)
+		}
+	}
+}
+
+func TestAttrsRoundTrip(t *testing.T) {
+	for _, flag := range AttrFlags {
+		attrs, err := ParseAttrs(AttrFlagNames(flag.Flag))
+		if err != nil || attrs != flag.Flag {
+			t.Errorf("%s: parsed back as %#x, %v", flag.Name, attrs, err)
+		}
+
+		if got := AttrFlagNames(flag.Flag); !reflect.DeepEqual(got, []string{flag.Name}) {
+			t.Errorf("AttrFlagNames(%#x) = %v, want [%s]", flag.Flag, got, flag.Name)
+		}
+	}
+
+	all := int32(0)
+	for _, flag := range AttrFlags {
+		all |= flag.Flag
+	}
+	if got := len(AttrFlagNames(all)); got != len(AttrFlags) {
+		t.Errorf("AttrFlagNames of every attribute returned %d names, want %d", got, len(AttrFlags))
+	}
+}
+
+func TestQueryPathAttrsSpecial(t *testing.T) {
+	oldRuntime, oldPath := runtimeDir, opLockPath
+	runtimeDir, opLockPath = t.TempDir(), filepath.Join(t.TempDir(), "almost.lock")
+	defer func() {
+		runtimeDir, opLockPath = oldRuntime, oldPath
+	}()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	fifo := filepath.Join(dir, "fifo")
+	link := filepath.Join(dir, "link")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(file, link); err != nil {
+		t.Fatal(err)
+	}
+
+	// the paths named explicitly are reported whatever their type
+	for _, path := range []string{fifo, link} {
+		states, err := QueryPathAttrs(path, false)
+		if err != nil {
+			t.Fatalf("QueryPathAttrs(%s): %s", path, err)
+		}
+		if len(states) != 1 || states[0].Path != path {
+			t.Fatalf("QueryPathAttrs(%s) = %v, want its state", path, states)
+		}
+	}
+
+	states, _ := QueryPathAttrs(link, false)
+	if !errors.Is(states[0].Err, errSymlinkAttrs) {
+		t.Errorf("symlink state error %v, want %v", states[0].Err, errSymlinkAttrs)
+	}
+
+	summary, err := ChangePathAttrs(link, FS_NOATIME_FL, 0, false)
+	if err != nil || summary.Failed != 1 {
+		t.Errorf("ChangePathAttrs(%s) = %+v, %v, want a failure", link, summary, err)
+	}
+
+	// their content is still filtered
+	states, err = QueryPathAttrs(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 {
+		t.Errorf("QueryPathAttrs(%s) = %v, want the directory and the file", dir, states)
+	}
+}
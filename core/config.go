@@ -3,81 +3,315 @@ package core
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
-	"github.com/spf13/viper"
+	"gopkg.in/ini.v1"
 )
 
 var (
-	Config   = "/etc/almost.ini"
-	Section  = "Almost"
-	Defaults = map[string]interface{}{
-		"Almost::CurrentMode":       "0", // 0 = ro, 1 = rw
-		"Almost::DefaultMode":       "0", // 0 = ro, 1 = rw
-		"Almost::PersistModeStatus": "0", // 0 = on, 1 = off
-	}
+	Config          = "/etc/almost.ini"
+	VendorConfig    = "/usr/share/almost/almost.ini"
+	ConfigDropInDir = "/etc/almost.ini.d"
+	RuntimeConfig   = "/run/almost/almost.ini"
+	Section         = "Almost"
+	// Defaults holds the default value of every key declared in Schema
+	Defaults = schemaDefaults()
 )
 
-func init() {
-	if !RootCheck(false) {
-		return
+// obsoleteKeys are no longer read but may still be found in the
+// configuration written by older versions, they are ignored silently
+var obsoleteKeys = map[string]bool{
+	"almost::currentmode": true,
+}
+
+// OriginDefault is the origin of the values no layer sets
+const OriginDefault = "default"
+
+/*
+ConfigValue is the effective value of a key and the layer it comes from,
+either a configuration file or OriginDefault.
+*/
+type ConfigValue struct {
+	Value  string
+	Origin string
+}
+
+/*
+ConfigLayers returns the configuration files in the order they are
+applied, each one overriding the previous ones: the vendor defaults, the
+admin configuration, its drop-ins in lexical order and the runtime
+overrides. Missing files are skipped when loading.
+*/
+func ConfigLayers() []string {
+	layers := []string{VendorConfig, Config}
+
+	dropIns, _ := filepath.Glob(filepath.Join(ConfigDropInDir, "*.ini"))
+	sort.Strings(dropIns)
+	layers = append(layers, dropIns...)
+
+	return append(layers, RuntimeConfig)
+}
+
+// configCache holds the last merged configuration, it is reused as long as
+// no layer changes so that an operation parses them once
+var configCache struct {
+	mutex    sync.Mutex
+	stamp    string
+	values   map[string]ConfigValue
+	warnings []string
+}
+
+/*
+LoadConfig merges the configuration layers, it returns the effective value
+of every key declared in Schema and a warning for every unknown key or
+invalid value found.
+*/
+func LoadConfig() (map[string]ConfigValue, []string, error) {
+	layers := ConfigLayers()
+	stamp := layersStamp(layers)
+
+	configCache.mutex.Lock()
+	defer configCache.mutex.Unlock()
+
+	if configCache.values == nil || configCache.stamp != stamp {
+		values, warnings, err := mergeConfigLayers(layers)
+		if err != nil {
+			return values, warnings, err
+		}
+		configCache.stamp = stamp
+		configCache.values = values
+		configCache.warnings = warnings
 	}
 
-	if _, err := os.Stat("/etc/almost"); os.IsNotExist(err) {
-		os.Mkdir("/etc/almost", 0755)
+	values := map[string]ConfigValue{}
+	for name, value := range configCache.values {
+		values[name] = value
 	}
+	return values, append([]string{}, configCache.warnings...), nil
+}
 
-	if _, err := os.Stat(Config); os.IsNotExist(err) {
-		f, err := os.Create(Config)
+// layersStamp identifies the content of the configuration layers by their
+// modification time and size
+func layersStamp(layers []string) string {
+	var stamp strings.Builder
+	for _, layer := range layers {
+		info, err := os.Stat(layer)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			fmt.Fprintf(&stamp, "%s:-\n", layer)
+			continue
 		}
-		f.Close()
+		fmt.Fprintf(&stamp, "%s:%d:%d\n", layer, info.ModTime().UnixNano(), info.Size())
 	}
-	viper.SetConfigFile(Config)
-	viper.SetConfigType("ini")
-	viper.SetDefault(Section, Defaults)
-	if err := viper.ReadInConfig(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	return stamp.String()
+}
+
+func mergeConfigLayers(layers []string) (map[string]ConfigValue, []string, error) {
+	values := map[string]ConfigValue{}
+	for _, key := range Schema {
+		values[key.Name] = ConfigValue{Value: key.Default, Origin: OriginDefault}
 	}
-	if err := viper.WriteConfig(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	warnings := []string{}
+
+	for _, layer := range layers {
+		if _, err := os.Stat(layer); os.IsNotExist(err) {
+			continue
+		}
+
+		f, err := loadConfigFile(layer)
+		if err != nil {
+			return values, warnings, err
+		}
+
+		for _, k := range f.Section(Section).Keys() {
+			if obsoleteKeys[strings.ToLower(k.Name())] {
+				continue
+			}
+			key, err := LookupKey(k.Name())
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("%s: %s", layer, err))
+				continue
+			}
+			if _, err := key.Normalize(k.Value()); err != nil {
+				warnings = append(warnings, fmt.Sprintf("%s: %s", layer, err))
+				continue
+			}
+			values[key.Name] = ConfigValue{Value: k.Value(), Origin: layer}
+		}
 	}
+
+	return values, warnings, nil
 }
 
+/*
+Load checks that the configuration layers can be read.
+*/
 func Load() error {
-	if err := viper.ReadInConfig(); err != nil {
+	_, _, err := LoadConfig()
+	return err
+}
+
+/*
+Set validates a value against the schema and stores it in its canonical
+form in /etc/almost.ini.
+*/
+func Set(name, value string) error {
+	return setIn(Config, name, value)
+}
+
+/*
+SetRuntime is like Set but stores the value in the runtime layer, which
+does not survive a reboot.
+*/
+func SetRuntime(name, value string) error {
+	return setIn(RuntimeConfig, name, value)
+}
+
+/*
+Unset removes a key from /etc/almost.ini, the value of the lower layers
+applies again.
+*/
+func Unset(name string) error {
+	return unsetIn(Config, name)
+}
+
+/*
+UnsetRuntime removes a key from the runtime layer.
+*/
+func UnsetRuntime(name string) error {
+	return unsetIn(RuntimeConfig, name)
+}
+
+/*
+Get returns the effective value of a key, as stored.
+*/
+func Get(name string) (string, error) {
+	key, err := LookupKey(name)
+	if err != nil {
+		return "", err
+	}
+
+	values, _, err := LoadConfig()
+	if err != nil {
+		return key.Default, err
+	}
+	return values[key.Name].Value, nil
+}
+
+/*
+Show prints the effective configuration, with the layer every value comes
+from if origin is set.
+*/
+func Show(origin bool) error {
+	values, warnings, err := LoadConfig()
+	if err != nil {
 		return err
 	}
+
+	for _, warning := range warnings {
+		logln("Warning:", warning)
+	}
+	for _, key := range Schema {
+		value, err := key.Normalize(values[key.Name].Value)
+		if err != nil {
+			value = key.Default
+		}
+		if origin {
+			logf("%s=%s (%s)\n", key.Name, value, values[key.Name].Origin)
+		} else {
+			logf("%s=%s\n", key.Name, value)
+		}
+	}
 	return nil
 }
 
-func Set(key, value string) error {
-	if err := Load(); err != nil {
+func loadConfigFile(path string) (*ini.File, error) {
+	// the key names contain "::", only "=" separates them from the values
+	return ini.LoadSources(ini.LoadOptions{Insensitive: true, Loose: true, KeyValueDelimiters: "="}, path)
+}
+
+func setIn(path string, name string, value string) error {
+	key, err := LookupKey(name)
+	if err != nil {
+		return err
+	}
+	value, err = key.Normalize(value)
+	if err != nil {
+		return err
+	}
+
+	f, err := loadConfigFile(path)
+	if err != nil {
 		return err
 	}
-	viper.Set(Section+"."+key, value)
-	if err := viper.WriteConfig(); err != nil {
+	f.Section(Section).Key(strings.ToLower(key.Name)).SetValue(value)
+
+	if err := saveConfigFile(f, path); err != nil {
 		return err
 	}
+
+	// a later layer, e.g. a drop-in, would keep the new value from
+	// applying
+	values, _, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	if origin := values[key.Name].Origin; origin != path {
+		logf("Warning: %s is overridden by %s, the new value does not apply\n", key.Name, origin)
+	}
 	return nil
 }
 
-func Get(key string) (string, error) {
-	if err := Load(); err != nil {
-		return "", err
+func unsetIn(path string, name string) error {
+	key, err := LookupKey(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	f, err := loadConfigFile(path)
+	if err != nil {
+		return err
 	}
-	return viper.GetString(Section + "." + key), nil
+
+	// the key may have been written without the Almost:: prefix
+	section := f.Section(Section)
+	for _, k := range section.Keys() {
+		if found, err := LookupKey(k.Name()); err == nil && found.Name == key.Name {
+			section.DeleteKey(k.Name())
+		}
+	}
+
+	return saveConfigFile(f, path)
 }
 
-func Show() error {
-	if err := Load(); err != nil {
+func saveConfigFile(f *ini.File, path string) error {
+	section := f.Section(Section)
+	for _, k := range section.Keys() {
+		if obsoleteKeys[strings.ToLower(k.Name())] {
+			section.DeleteKey(k.Name())
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return err
 	}
-	for k, v := range viper.GetStringMap(Section) {
-		fmt.Printf("%s=%s\n", k, v)
+	tmpPath := path + ".tmp"
+	if err := f.SaveTo(tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
 	}
+
+	// the layers are compared by modification time, which may not change
+	// between two quick writes
+	configCache.mutex.Lock()
+	configCache.values = nil
+	configCache.mutex.Unlock()
 	return nil
 }
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergeConfigLayers(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	vendor := write("vendor.ini", `[Almost]
+Almost::DefaultMode = rw
+Almost::MaxDepth = 4
+Almost::Backend = bindmount
+`)
+	admin := write("almost.ini", `[almost]
+almost::defaultmode=ro
+MaxDepth = 8
+Almost::Colour = blue
+`)
+	dropIn := write("10-paths.ini", `[Almost]
+Almost::IncludePaths = /opt, /srv/*
+Almost::MaxDepth = -7
+`)
+	runtime := write("runtime.ini", `[Almost]
+Almost::SessionAudit = off
+`)
+	missing := filepath.Join(dir, "missing.ini")
+
+	values, warnings, err := mergeConfigLayers([]string{vendor, admin, dropIn, missing, runtime})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key    string
+		value  string
+		origin string
+	}{
+		{"Almost::DefaultMode", "ro", admin},
+		// the invalid value of the drop-in is skipped
+		{"Almost::MaxDepth", "8", admin},
+		{"Almost::Backend", "bindmount", vendor},
+		{"Almost::IncludePaths", "/opt, /srv/*", dropIn},
+		{"Almost::SessionAudit", "off", runtime},
+		{"Almost::PersistModeStatus", "on", OriginDefault},
+	}
+	for _, test := range tests {
+		got := values[test.key]
+		if got.Value != test.value || got.Origin != test.origin {
+			t.Errorf("%s = %q from %s, want %q from %s", test.key, got.Value, got.Origin, test.value, test.origin)
+		}
+	}
+
+	if len(warnings) != 2 {
+		t.Fatalf("warnings %q, want the unknown key and the invalid value", warnings)
+	}
+	if !strings.HasPrefix(warnings[0], admin) || !strings.Contains(warnings[0], "colour") {
+		t.Errorf("warning %q, want the unknown key of %s", warnings[0], admin)
+	}
+	if !strings.HasPrefix(warnings[1], dropIn) || !strings.Contains(warnings[1], "-7") {
+		t.Errorf("warning %q, want the invalid value of %s", warnings[1], dropIn)
+	}
+}
+
+func TestMergeConfigLayersObsolete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "almost.ini")
+	if err := os.WriteFile(path, []byte("[Almost]\nAlmost::CurrentMode = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, warnings, err := mergeConfigLayers([]string{path})
+	if err != nil || len(warnings) != 0 {
+		t.Errorf("got %q, %v, want the obsolete key to be ignored silently", warnings, err)
+	}
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+Strategy defines how a managed path is protected when the system is locked.
+*/
+type Strategy string
+
+const (
+	// StrategyChattr sets the immutable (or append-only) flag on every file
+	StrategyChattr Strategy = "chattr"
+	// StrategyBindMount bind mounts the path on itself as read-only
+	StrategyBindMount Strategy = "bindmount"
+	// StrategyNone leaves the path unprotected
+	StrategyNone Strategy = "none"
+)
+
+/*
+ParseStrategy returns the strategy with the given name.
+*/
+func ParseStrategy(name string) (Strategy, error) {
+	switch strategy := Strategy(name); strategy {
+	case StrategyChattr, StrategyBindMount, StrategyNone:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown strategy: %s", name)
+	}
+}
+
+/*
+FsInfo describes the file system a managed path lives on.
+*/
+type FsInfo struct {
+	Type          string
+	SupportsAttrs bool
+}
+
+// names of the common file systems, the support of the file attributes is
+// probed, a file system may support them or not depending on how it is
+// mounted, e.g. overlay
+var fsNames = map[uint32]string{
+	unix.EXT4_SUPER_MAGIC:      "ext4",
+	unix.BTRFS_SUPER_MAGIC:     "btrfs",
+	unix.XFS_SUPER_MAGIC:       "xfs",
+	unix.F2FS_SUPER_MAGIC:      "f2fs",
+	unix.REISERFS_SUPER_MAGIC:  "reiserfs",
+	unix.TMPFS_MAGIC:           "tmpfs",
+	unix.RAMFS_MAGIC:           "ramfs",
+	unix.OVERLAYFS_SUPER_MAGIC: "overlay",
+	unix.MSDOS_SUPER_MAGIC:     "vfat",
+	unix.EXFAT_SUPER_MAGIC:     "exfat",
+	unix.FUSE_SUPER_MAGIC:      "fuse",
+	unix.NFS_SUPER_MAGIC:       "nfs",
+	unix.CIFS_SUPER_MAGIC:      "cifs",
+	unix.SMB2_SUPER_MAGIC:      "smb2",
+	unix.SQUASHFS_MAGIC:        "squashfs",
+	unix.ISOFS_SUPER_MAGIC:     "iso9660",
+	0x2fc12fc1:                 "zfs",
+	0x3153464a:                 "jfs",
+	0xca451a4e:                 "bcachefs",
+}
+
+// file systems known to support the immutable and append-only flags, used
+// when the probe cannot tell, e.g. on a path bind mounted read-only
+var attrFilesystems = map[uint32]bool{
+	unix.EXT4_SUPER_MAGIC:     true,
+	unix.BTRFS_SUPER_MAGIC:    true,
+	unix.XFS_SUPER_MAGIC:      true,
+	unix.F2FS_SUPER_MAGIC:     true,
+	unix.REISERFS_SUPER_MAGIC: true,
+	0x2fc12fc1:                true,
+	0x3153464a:                true,
+	0xca451a4e:                true,
+}
+
+/*
+DetectFs detects the file system of the given path and whether it supports
+the file attributes almost relies on. The support is probed by reading the
+attributes of the path and setting them back unchanged.
+*/
+func DetectFs(path string) (FsInfo, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return FsInfo{}, err
+	}
+
+	magic := uint32(st.Type)
+	name := fsNames[magic]
+	if name == "" {
+		name = fmt.Sprintf("0x%x", magic)
+	}
+
+	supported, err := probeAttrs(path)
+	if err != nil {
+		supported = attrFilesystems[magic]
+	}
+
+	return FsInfo{Type: name, SupportsAttrs: supported}, nil
+}
+
+// probeAttrs tells whether the file system of path supports the file
+// attributes, the error is set when it cannot tell, e.g. on a read-only
+// mount
+func probeAttrs(path string) (bool, error) {
+	f, err := OpenAttrFile(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	attrs, err := GetAttrs(f)
+	if err == nil {
+		err = ioctl(f, FS_IOC_SETFLAGS, &attrs)
+	}
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, unix.ENOTTY), errors.Is(err, unix.EOPNOTSUPP),
+		errors.Is(err, unix.EINVAL), errors.Is(err, unix.ENOSYS):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+/*
+StrategyFor returns the strategy, i.e. the backend, protecting the given
+managed path. The strategy given in the path policy wins, then the backend
+set in Almost::Backend is used if the file system supports it. The chattr
+backend needs file attributes, when they are not supported
+Almost::UnsupportedFs decides what to do: warn (leave the path
+unprotected), bindmount or refuse.
+*/
+func (r PathRules) StrategyFor(path string) (Strategy, FsInfo, error) {
+	info, err := DetectFs(path)
+	if err != nil {
+		return StrategyNone, info, err
+	}
+
+	if strategy := r.PolicyOf(path).Strategy; strategy != "" {
+		return strategy, info, nil
+	}
+
+	backend := GetValue("Almost::Backend")
+	if backend == string(StrategyBindMount) {
+		return StrategyBindMount, info, nil
+	}
+	if info.SupportsAttrs {
+		return StrategyChattr, info, nil
+	}
+
+	fallback := GetValue("Almost::UnsupportedFs")
+	switch fallback {
+	case "refuse":
+		return StrategyNone, info, fmt.Errorf("%s is on %s which does not support file attributes", path, info.Type)
+	case string(StrategyBindMount):
+		return StrategyBindMount, info, nil
+	default:
+		return StrategyNone, info, nil
+	}
+}
@@ -0,0 +1,563 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Paths holds the locations almost reads and writes, the files of every
+directory are laid out as on a running system.
+*/
+type Paths struct {
+	// Config is the admin configuration, /etc/almost.ini
+	Config string
+	// VendorConfig holds the vendor defaults, /usr/share/almost/almost.ini
+	VendorConfig string
+	// ConfigDropIns holds the configuration drop-ins, /etc/almost.ini.d
+	ConfigDropIns string
+	// Data holds the path rules, hooks, overlays, flag inventory and
+	// integrity manifest, /etc/almost
+	Data string
+	// Runtime holds the runtime state and configuration and the operation
+	// lock, /run/almost
+	Runtime string
+	// States and StatesTrash hold the states of /usr, /var/almost/states
+	// and /var/almost/trash
+	States      string
+	StatesTrash string
+	// StateMountUnit mounts the states at boot,
+	// /etc/systemd/system/usr.mount
+	StateMountUnit string
+	// Units holds the mount units of the persistent overlays,
+	// /etc/systemd/system
+	Units string
+	// Sessions holds the reports of the read-write sessions,
+	// /var/log/almost/sessions
+	Sessions string
+}
+
+var (
+	// defaultPaths are the locations used on a running system
+	defaultPaths = currentPaths()
+	// rootDir is the alternate root almost operates on, empty for the
+	// running system
+	rootDir = ""
+)
+
+/*
+DefaultPaths returns the locations used on a running system.
+*/
+func DefaultPaths() Paths {
+	return defaultPaths
+}
+
+/*
+WithRoot returns the paths resolved below the given root directory.
+*/
+func (p Paths) WithRoot(root string) Paths {
+	join := func(path string) string {
+		return filepath.Join(root, path)
+	}
+
+	return Paths{
+		Config:         join(p.Config),
+		VendorConfig:   join(p.VendorConfig),
+		ConfigDropIns:  join(p.ConfigDropIns),
+		Data:           join(p.Data),
+		Runtime:        join(p.Runtime),
+		States:         join(p.States),
+		StatesTrash:    join(p.StatesTrash),
+		StateMountUnit: join(p.StateMountUnit),
+		Units:          join(p.Units),
+		Sessions:       join(p.Sessions),
+	}
+}
+
+func currentPaths() Paths {
+	return Paths{
+		Config:         Config,
+		VendorConfig:   VendorConfig,
+		ConfigDropIns:  ConfigDropInDir,
+		Data:           almostDir,
+		Runtime:        runtimeDir,
+		States:         statesPath,
+		StatesTrash:    statesTrashPath,
+		StateMountUnit: stateMountUnitPath,
+		Units:          overlayUnitsDir,
+		Sessions:       sessionsDir,
+	}
+}
+
+/*
+SetPaths changes the locations almost reads and writes.
+*/
+func SetPaths(p Paths) {
+	Config = p.Config
+	VendorConfig = p.VendorConfig
+	ConfigDropInDir = p.ConfigDropIns
+
+	almostDir = p.Data
+	pathsDropInDir = filepath.Join(p.Data, "paths.d")
+	hooksDir = filepath.Join(p.Data, "hooks.d")
+	inventoryPath = filepath.Join(p.Data, "flags.inventory")
+	exceptionsPath = filepath.Join(p.Data, "flags.exceptions")
+	manifestPath = filepath.Join(p.Data, "manifest")
+	manifestSigPath = filepath.Join(p.Data, "manifest.sig")
+	manifestKeyPath = filepath.Join(p.Data, "manifest.key")
+	manifestPubPath = filepath.Join(p.Data, "manifest.pub")
+	overlaysPath = filepath.Join(p.Data, "overlays")
+	overlaysDbPath = filepath.Join(p.Data, "overlays.db")
+
+	runtimeDir = p.Runtime
+	RuntimeConfig = filepath.Join(p.Runtime, "almost.ini")
+	statePath = filepath.Join(p.Runtime, "state.json")
+	opLockPath = filepath.Join(p.Runtime, "almost.lock")
+
+	statesPath = p.States
+	statesTrashPath = p.StatesTrash
+	stateMountUnitPath = p.StateMountUnit
+	overlayUnitsDir = p.Units
+	sessionsDir = p.Sessions
+}
+
+/*
+SetRoot makes almost operate on the system installed in the given
+directory, e.g. a chroot or a mounted disk image: the configuration, the
+state and the managed paths are resolved below it. The operations needing
+the live kernel are skipped, bind mounts are left to the first boot, or
+refused, e.g. overlays. An empty root means the running system.
+*/
+func SetRoot(root string) error {
+	if root == "" || root == "/" {
+		rootDir = ""
+		SetPaths(DefaultPaths())
+		return nil
+	}
+
+	root, err := checkRoot(root)
+	if err != nil {
+		return err
+	}
+
+	rootDir = root
+	SetPaths(DefaultPaths().WithRoot(root))
+	return nil
+}
+
+/*
+Root returns the alternate root set with SetRoot, empty for the running
+system.
+*/
+func Root() string {
+	return rootDir
+}
+
+func checkRoot(root string) (string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", root)
+	}
+	return root, nil
+}
+
+// rooted returns where a path of the target system is found
+func rooted(path string) string {
+	return filepath.Join(rootDir, path)
+}
+
+// unrooted returns the path on the target system of a file found below
+// the alternate root
+func unrooted(path string) string {
+	if rootDir == "" || !isSubPath(rootDir, path) {
+		return path
+	}
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(path, rootDir), "/")
+}
+
+// requireLiveSystem fails if an alternate root is set, for the operations
+// which need the running kernel
+func requireLiveSystem(operation string) error {
+	if rootDir != "" {
+		return fmt.Errorf("%s needs the running system, it is not available with an alternate root", operation)
+	}
+	return nil
+}
+
+/*
+Options configures an Almost handle.
+*/
+type Options struct {
+	// Root is the directory the paths are resolved below, the running
+	// system if empty
+	Root string
+	// Paths overrides the default locations, they are resolved below
+	// Root too
+	Paths *Paths
+	// Output receives the messages of the operations, they are discarded
+	// if nil
+	Output io.Writer
+	// DryRun makes the operations print what they would do instead of
+	// doing it
+	DryRun bool
+	// LockWait is how long operations wait for the one running, in this
+	// process or in another one, to finish
+	LockWait time.Duration
+}
+
+/*
+Almost is a handle to the almost operations, it can be used by programs
+importing github.com/vanilla-os/almost/core, see New. Every call runs with
+the settings of the handle and calls from different handles are
+serialized, the package level functions use the settings of the process
+instead, see SetRoot, SetPaths, SetOutput, SetDryRun and SetLockWait.
+
+The settings are not threaded through the operations: a call swaps the
+package level settings for the ones of the handle and restores them when
+done, holding a lock shared by all the handles. Calls to the package level
+functions made meanwhile from other goroutines see the settings of the
+handle, so a program should use either handles or the package level
+functions. The messages are written as plain text to the Output writer,
+there is no structured logging.
+*/
+type Almost struct {
+	settings settings
+}
+
+type settings struct {
+	root     string
+	paths    Paths
+	output   io.Writer
+	dryRun   bool
+	lockWait time.Duration
+}
+
+// handleMutex serializes the calls made through the handles, since they
+// share the package state
+var handleMutex sync.Mutex
+
+/*
+New returns a handle with the given options, nothing is read or written
+until an operation is called.
+*/
+func New(opts Options) (*Almost, error) {
+	paths := DefaultPaths()
+	if opts.Paths != nil {
+		paths = *opts.Paths
+	}
+
+	root := ""
+	if opts.Root != "" && opts.Root != "/" {
+		var err error
+		if root, err = checkRoot(opts.Root); err != nil {
+			return nil, err
+		}
+		paths = paths.WithRoot(root)
+	}
+
+	output := opts.Output
+	if output == nil {
+		output = io.Discard
+	}
+
+	return &Almost{settings: settings{
+		root:     root,
+		paths:    paths,
+		output:   output,
+		dryRun:   opts.DryRun,
+		lockWait: opts.LockWait,
+	}}, nil
+}
+
+/*
+Paths returns the locations used by the handle.
+*/
+func (a *Almost) Paths() Paths {
+	return a.settings.paths
+}
+
+// use applies the settings of the handle until the returned function is
+// called, which restores the previous ones
+func (a *Almost) use() func() {
+	handleMutex.Lock()
+
+	previous := settings{
+		root:     rootDir,
+		paths:    currentPaths(),
+		output:   output,
+		dryRun:   dryRun,
+		lockWait: lockWait(),
+	}
+	a.settings.apply()
+
+	return func() {
+		previous.apply()
+		handleMutex.Unlock()
+	}
+}
+
+func (s settings) apply() {
+	rootDir = s.root
+	SetPaths(s.paths)
+	SetOutput(s.output)
+	SetDryRun(s.dryRun)
+	SetLockWait(s.lockWait)
+}
+
+/*
+EnterRo locks the managed paths, see TransitionOptions.
+*/
+func (a *Almost) EnterRo(opts TransitionOptions) error {
+	defer a.use()()
+	return EnterRo(opts)
+}
+
+/*
+EnterRw unlocks the managed paths, see TransitionOptions.
+*/
+func (a *Almost) EnterRw(opts TransitionOptions) error {
+	defer a.use()()
+	return EnterRw(opts)
+}
+
+/*
+EnterDefault puts every managed path in its default mode.
+*/
+func (a *Almost) EnterDefault(opts TransitionOptions) error {
+	defer a.use()()
+	return EnterDefault(opts, false)
+}
+
+/*
+CurrentMode returns the mode of the managed paths as a whole.
+*/
+func (a *Almost) CurrentMode() (string, error) {
+	defer a.use()()
+	return CurrentMode()
+}
+
+/*
+ModeState returns the runtime state.
+*/
+func (a *Almost) ModeState() (ModeState, error) {
+	defer a.use()()
+	return LoadModeState()
+}
+
+/*
+PathRules returns the rules defining the managed paths.
+*/
+func (a *Almost) PathRules() (PathRules, error) {
+	defer a.use()()
+	return LoadPathRules()
+}
+
+/*
+Verify compares the attributes of the managed paths with the given mode,
+fixing the drift if fix is set.
+*/
+func (a *Almost) Verify(mode string, fix bool) (VerifyReport, error) {
+	defer a.use()()
+	return Verify(mode, fix, false)
+}
+
+/*
+VerifyIntegrity compares the managed paths with the integrity manifest.
+*/
+func (a *Almost) VerifyIntegrity() (IntegrityReport, error) {
+	defer a.use()()
+	return VerifyIntegrity()
+}
+
+/*
+ChangePathAttrs sets and unsets attributes on a path, see ChangePathAttrs.
+*/
+func (a *Almost) ChangePathAttrs(path string, set int32, unset int32, recursive bool) (WalkSummary, error) {
+	defer a.use()()
+	return ChangePathAttrs(path, set, unset, recursive)
+}
+
+/*
+QueryPathAttrs retrieves the attributes of a path, see QueryPathAttrs.
+*/
+func (a *Almost) QueryPathAttrs(path string, recursive bool) ([]AttrState, error) {
+	defer a.use()()
+	return QueryPathAttrs(path, recursive)
+}
+
+/*
+AcquireLease takes a read-write lease, see AcquireLease.
+*/
+func (a *Almost) AcquireLease(command string, opts TransitionOptions) (*Lease, error) {
+	defer a.use()()
+	return AcquireLease(command, opts)
+}
+
+/*
+ReleaseLease drops a lease taken with AcquireLease.
+*/
+func (a *Almost) ReleaseLease(lease *Lease, opts TransitionOptions) error {
+	defer a.use()()
+	return lease.Release(opts)
+}
+
+/*
+OpenWindow unlocks the managed paths until the given duration has elapsed.
+*/
+func (a *Almost) OpenWindow(duration time.Duration, opts TransitionOptions) error {
+	defer a.use()()
+	return OpenWindow(duration, opts)
+}
+
+/*
+ExtendWindow postpones the expiration of the current window.
+*/
+func (a *Almost) ExtendWindow(duration time.Duration) error {
+	defer a.use()()
+	return ExtendWindow(duration)
+}
+
+/*
+CancelWindow drops the current window, locking its paths if relock is set.
+*/
+func (a *Almost) CancelWindow(relock bool, opts TransitionOptions) error {
+	defer a.use()()
+	return CancelWindow(relock, opts)
+}
+
+/*
+CurrentWindow returns the open read-write window, nil if there is none.
+*/
+func (a *Almost) CurrentWindow() (*Window, error) {
+	defer a.use()()
+	return CurrentWindow()
+}
+
+/*
+OverlayAdd mounts a writable overlay on the given path, mounted again at
+boot if persist is set.
+*/
+func (a *Almost) OverlayAdd(path string, force bool, persist bool) error {
+	defer a.use()()
+	return OverlayAdd(path, force, persist, false)
+}
+
+/*
+OverlayRemove removes the overlay of the given path, its changes are
+copied to the path if keep is set, discarded otherwise.
+*/
+func (a *Almost) OverlayRemove(path string, keep bool) error {
+	defer a.use()()
+	return OverlayRemove(path, keep, false)
+}
+
+/*
+OverlayList returns the registered overlays.
+*/
+func (a *Almost) OverlayList() ([]Overlay, error) {
+	defer a.use()()
+	return OverlayList()
+}
+
+/*
+OfflineUpdate installs the prepared offline updates through an overlay on
+/usr.
+*/
+func (a *Almost) OfflineUpdate() error {
+	defer a.use()()
+	return OfflineUpdate()
+}
+
+/*
+StateNew creates a new state of /usr.
+*/
+func (a *Almost) StateNew() error {
+	defer a.use()()
+	return StateNew()
+}
+
+/*
+StateTrash moves a state to the trash.
+*/
+func (a *Almost) StateTrash(id string) error {
+	defer a.use()()
+	return StateTrash(id)
+}
+
+/*
+StateList returns the states and the trashed states.
+*/
+func (a *Almost) StateList() ([]string, []string, error) {
+	defer a.use()()
+	return StateList()
+}
+
+/*
+Get returns the effective value of a configuration key.
+*/
+func (a *Almost) Get(name string) (string, error) {
+	defer a.use()()
+	return Get(name)
+}
+
+/*
+Set stores a configuration value in the admin configuration.
+*/
+func (a *Almost) Set(name, value string) error {
+	defer a.use()()
+	return Set(name, value)
+}
+
+/*
+Unset removes a key from the admin configuration.
+*/
+func (a *Almost) Unset(name string) error {
+	defer a.use()()
+	return Unset(name)
+}
+
+/*
+StartSession starts recording the changes made to the managed paths, see
+StartSession. The session, nil if auditing is disabled, must be stopped
+with StopSession.
+*/
+func (a *Almost) StartSession(command []string) (*Session, error) {
+	defer a.use()()
+	return StartSession(command)
+}
+
+/*
+StopSession ends a session started with StartSession and saves its report.
+*/
+func (a *Almost) StopSession(session *Session) (SessionReport, error) {
+	defer a.use()()
+	return session.Stop()
+}
+
+/*
+ListSessions returns the reports of the recorded sessions, oldest first.
+*/
+func (a *Almost) ListSessions() ([]SessionReport, error) {
+	defer a.use()()
+	return ListSessions()
+}
+
+/*
+LoadSession returns the report of the session with the given ID.
+*/
+func (a *Almost) LoadSession(id string) (SessionReport, error) {
+	defer a.use()()
+	return LoadSession(id)
+}
@@ -4,6 +4,18 @@ import (
 	"os/exec"
 )
 
+// systemctl manages the units of the target system, with an alternate root
+// only the unit files are changed and there is no daemon to reload
+func systemctl(args ...string) error {
+	if rootDir != "" {
+		if args[0] == "daemon-reload" {
+			return nil
+		}
+		args = append([]string{"--root=" + rootDir}, args...)
+	}
+	return exec.Command("systemctl", args...).Run()
+}
+
 func CurrentUser() string {
 	cmd := exec.Command("logname")
 	out, err := cmd.Output()
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var hooksDir = "/etc/almost/hooks.d"
+
+// events hooks can be attached to, the hooks of an event live in the
+// pre-<event> and post-<event> directories of hooksDir
+const (
+	HookLock           = "lock"
+	HookUnlock         = "unlock"
+	HookStateNew       = "state-new"
+	HookOverlayCommit  = "overlay-commit"
+	HookOverlayDiscard = "overlay-discard"
+)
+
+/*
+HookEnv holds the variables describing an event, passed to the hooks as
+ALMOST_<KEY> environment variables.
+*/
+type HookEnv map[string]string
+
+/*
+RunPreHooks runs the pre hooks of the given event in lexical order, the
+first failing hook aborts the event and its error is returned.
+*/
+func RunPreHooks(event string, env HookEnv) error {
+	for _, hook := range listHooks("pre-" + event) {
+		if err := runHook(hook, "pre", event, env); err != nil {
+			return fmt.Errorf("pre-%s hook %s failed: %s", event, filepath.Base(hook), err)
+		}
+	}
+
+	return nil
+}
+
+/*
+RunPostHooks runs the post hooks of the given event in lexical order, the
+result of the event is passed as ALMOST_RESULT (success or failure) and
+ALMOST_ERROR. Failing hooks are reported but do not stop the others.
+*/
+func RunPostHooks(event string, env HookEnv, eventErr error) {
+	postEnv := HookEnv{"RESULT": "success"}
+	for key, value := range env {
+		postEnv[key] = value
+	}
+	if eventErr != nil {
+		postEnv["RESULT"] = "failure"
+		postEnv["ERROR"] = eventErr.Error()
+	}
+
+	for _, hook := range listHooks("post-" + event) {
+		if err := runHook(hook, "post", event, postEnv); err != nil {
+			logf("Warning: post-%s hook %s failed: %s\n", event, filepath.Base(hook), err)
+		}
+	}
+}
+
+// listHooks returns the executable files in the given hook directory,
+// hidden files and backups are ignored
+func listHooks(name string) []string {
+	entries, err := os.ReadDir(filepath.Join(hooksDir, name))
+	if err != nil {
+		return nil
+	}
+
+	hooks := []string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || strings.HasSuffix(entry.Name(), "~") {
+			continue
+		}
+
+		// symlinks to executables are allowed
+		path := filepath.Join(hooksDir, name, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		hooks = append(hooks, path)
+	}
+	sort.Strings(hooks)
+
+	// the hooks of the target system would run against the host
+	if rootDir != "" && len(hooks) > 0 {
+		logf("Skipping the %s hooks, they do not run with an alternate root\n", name)
+		return nil
+	}
+
+	return hooks
+}
+
+func runHook(hook string, stage string, event string, env HookEnv) error {
+	if dryRun {
+		logf("Would run the %s-%s hook %s\n", stage, event, hook)
+		return nil
+	}
+
+	cmd := exec.Command(hook)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Env = append(os.Environ(), "ALMOST_EVENT="+event, "ALMOST_HOOK="+stage)
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, "ALMOST_"+key+"="+value)
+	}
+
+	return cmd.Run()
+}
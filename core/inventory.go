@@ -0,0 +1,183 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	inventoryPath  = "/etc/almost/flags.inventory"
+	exceptionsPath = "/etc/almost/flags.exceptions"
+)
+
+/*
+inventoryMask holds the attributes recorded in the inventory and restored
+when the system is locked again.
+*/
+const inventoryMask int32 = FS_IMMUTABLE_FL | FS_APPEND_FL
+
+/*
+Inventory maps files under the managed paths to their attributes. The
+inventory recorded on unlock holds the attributes files had before, the
+exceptions saved on lock hold the files whose locked attributes differ from
+the ones the path rules would give them.
+*/
+type Inventory map[string]int32
+
+/*
+LoadInventory reads the inventory recorded by the last unlock, it returns a
+nil inventory if none has been recorded.
+*/
+func LoadInventory() (Inventory, error) {
+	return loadInventoryFile(inventoryPath)
+}
+
+/*
+LoadExceptions reads the exceptions saved by the last lock, it returns a
+nil inventory if none have been saved.
+*/
+func LoadExceptions() (Inventory, error) {
+	return loadInventoryFile(exceptionsPath)
+}
+
+/*
+LoadLockedAttrs returns the attributes the files must have while the
+system is locked: the exceptions saved by the last lock, overridden by the
+inventory recorded by the last unlock.
+*/
+func LoadLockedAttrs() (Inventory, error) {
+	exceptions, err := LoadExceptions()
+	if err != nil {
+		return nil, err
+	}
+
+	inv, err := LoadInventory()
+	if err != nil {
+		return nil, err
+	}
+
+	locked := Inventory{}
+	for path, attrs := range exceptions {
+		locked[path] = attrs
+	}
+	for path, attrs := range inv {
+		locked[path] = attrs
+	}
+
+	return locked, nil
+}
+
+func loadInventoryFile(path string) (Inventory, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	inv := Inventory{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		attrs, path, found := strings.Cut(scanner.Text(), "\t")
+		if !found {
+			continue
+		}
+
+		value, err := strconv.ParseUint(attrs, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed inventory entry for %s: %s", path, err)
+		}
+		inv[rooted(path)] = int32(value)
+	}
+
+	return inv, scanner.Err()
+}
+
+/*
+Save writes the inventory to disk, replacing the previous one atomically.
+An inventory without any immutable or append-only entry is removed
+instead, it is recorded from paths which have never been locked and
+restoring it would leave everything writable.
+*/
+func (inv Inventory) Save() error {
+	if !inv.Locked() {
+		return RemoveInventory()
+	}
+
+	return inv.saveTo(inventoryPath)
+}
+
+/*
+SaveExceptions writes the inventory as the exceptions to apply on lock.
+*/
+func (inv Inventory) SaveExceptions() error {
+	return inv.saveTo(exceptionsPath)
+}
+
+func (inv Inventory) saveTo(path string) error {
+	var buf bytes.Buffer
+	for path, attrs := range inv {
+		// paths with a newline cannot be represented, they are treated as
+		// new files on restore
+		if strings.ContainsRune(path, '\n') {
+			continue
+		}
+		fmt.Fprintf(&buf, "%08x\t%s\n", uint32(attrs), unrooted(path))
+	}
+
+	return writeFileAtomic(path, buf.Bytes(), 0600)
+}
+
+/*
+Locked checks whether the inventory contains at least one immutable or
+append-only file.
+*/
+func (inv Inventory) Locked() bool {
+	for _, attrs := range inv {
+		if attrs&inventoryMask != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Exceptions returns the entries under root whose attributes differ from the
+ones the path rules would give them when locked.
+*/
+func (inv Inventory) Exceptions(root string, rules PathRules) Inventory {
+	exceptions := Inventory{}
+	for path, attrs := range inv {
+		if isSubPath(root, path) && attrs&inventoryMask != rules.LockAttr(path) {
+			exceptions[path] = attrs
+		}
+	}
+	return exceptions
+}
+
+/*
+RemoveUnder deletes the entries under root.
+*/
+func (inv Inventory) RemoveUnder(root string) {
+	for path := range inv {
+		if isSubPath(root, path) {
+			delete(inv, path)
+		}
+	}
+}
+
+/*
+RemoveInventory deletes the recorded inventory, if any.
+*/
+func RemoveInventory() error {
+	if err := os.Remove(inventoryPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInventoryRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flags.inventory")
+
+	inv := Inventory{
+		"/usr/bin/ls":            FS_IMMUTABLE_FL,
+		"/var/log/audit":         FS_APPEND_FL,
+		"/usr/share/with space":  FS_IMMUTABLE_FL | FS_APPEND_FL,
+		"/usr/share/with\ttab":   0,
+		"/usr/share/ünïcode":     FS_IMMUTABLE_FL,
+		"/usr/share/new\nline":   FS_IMMUTABLE_FL,
+		"/usr/lib/high-bit-attr": -1,
+	}
+	if err := inv.saveTo(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadInventoryFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// paths with a newline cannot be represented
+	delete(inv, "/usr/share/new\nline")
+	if !reflect.DeepEqual(loaded, inv) {
+		t.Errorf("loaded %v, want %v", loaded, inv)
+	}
+}
+
+func TestLoadInventoryFileMissing(t *testing.T) {
+	inv, err := loadInventoryFile(filepath.Join(t.TempDir(), "missing"))
+	if err != nil || inv != nil {
+		t.Errorf("got %v, %v, want a nil inventory", inv, err)
+	}
+}
+
+func TestLoadInventoryFileMalformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flags.inventory")
+	if err := os.WriteFile(path, []byte("zz\t/usr/bin/ls\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadInventoryFile(path); err == nil {
+		t.Error("no error for a malformed entry")
+	}
+}
+
+func TestInventorySave(t *testing.T) {
+	previous := inventoryPath
+	inventoryPath = filepath.Join(t.TempDir(), "flags.inventory")
+	t.Cleanup(func() { inventoryPath = previous })
+
+	tests := []struct {
+		name string
+		inv  Inventory
+		kept bool
+	}{
+		{"immutable", Inventory{"/usr/bin/ls": FS_IMMUTABLE_FL}, true},
+		{"append-only", Inventory{"/var/log/audit": FS_APPEND_FL}, true},
+		{"never locked", Inventory{"/usr/bin/ls": 0x80000}, false},
+		{"empty", Inventory{}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.inv.Save(); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		_, err := os.Stat(inventoryPath)
+		if kept := err == nil; kept != test.kept {
+			t.Errorf("%s: inventory kept %v, want %v", test.name, kept, test.kept)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Lease keeps the system read-write on behalf of a process, e.g. almost run,
+the system is locked again only once the last live lease is released. The
+leases are kept in the runtime state.
+*/
+type Lease struct {
+	ID      string    `json:"id"`
+	Pid     int       `json:"pid"`
+	Command string    `json:"command"`
+	Since   time.Time `json:"since"`
+	// StartTime is the start time of the process in clock ticks since
+	// boot, it tells apart a process reusing the pid of a dead one
+	StartTime uint64 `json:"start_time"`
+}
+
+/*
+Alive checks whether the process holding the lease is still running.
+*/
+func (l Lease) Alive() bool {
+	startTime, err := processStartTime(l.Pid)
+	return err == nil && startTime == l.StartTime
+}
+
+/*
+AcquireLease takes a read-write lease for the current process, unlocking
+the system unless another live lease already did.
+*/
+func AcquireLease(command string, opts TransitionOptions) (*Lease, error) {
+	if err := requireLiveSystem("a read-write lease"); err != nil {
+		return nil, err
+	}
+
+	unlockOperation, err := LockOperation()
+	if err != nil {
+		return nil, err
+	}
+	defer unlockOperation()
+
+	return acquireLease(command, opts)
+}
+
+// acquireLease takes a read-write lease, the caller holds the operation
+// lock
+func acquireLease(command string, opts TransitionOptions) (*Lease, error) {
+	state, _, err := reapLeases()
+	if err != nil {
+		return nil, err
+	}
+	leases := state.Leases
+
+	startTime, err := processStartTime(os.Getpid())
+	if err != nil {
+		return nil, err
+	}
+	lease := &Lease{
+		ID:        fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano()),
+		Pid:       os.Getpid(),
+		Command:   command,
+		Since:     time.Now(),
+		StartTime: startTime,
+	}
+
+	// only the paths which are not read-write yet are unlocked, and locked
+	// again once the last lease is released, the others were left
+	// read-write on purpose, e.g. by their default mode
+	unlocked, err := readOnlyPaths(state, opts.Paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(unlocked) == 0 {
+		if len(leases) > 0 {
+			logf("System already unlocked by %d other lease(s).\n", len(leases))
+		} else {
+			logln("System already unlocked.")
+		}
+	} else {
+		if opts.Reason == "" {
+			opts.Reason = "lease taken by " + command
+		}
+		opts.Paths = unlocked
+		if err := enterMode(ModeRw, opts); err != nil {
+			return nil, err
+		}
+	}
+	if dryRun {
+		return lease, nil
+	}
+
+	// the transition updated the state
+	state, err = LoadModeState()
+	if err != nil {
+		return nil, err
+	}
+	if len(leases) == 0 {
+		state.LeasePaths = nil
+	}
+	state.LeasePaths = appendMissing(state.LeasePaths, unlocked)
+	state.Leases = append(state.LiveLeases(), *lease)
+	if err := state.Save(); err != nil {
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+/*
+Release drops the lease and locks the paths unlocked by the leases again
+if no other live lease is left and no read-write window is open.
+*/
+func (l *Lease) Release(opts TransitionOptions) error {
+	unlockOperation, err := LockOperation()
+	if err != nil {
+		return err
+	}
+	defer unlockOperation()
+
+	return l.release(opts)
+}
+
+// release drops the lease, the caller holds the operation lock
+func (l *Lease) release(opts TransitionOptions) error {
+	if opts.Reason == "" {
+		opts.Reason = "lease released by " + l.Command
+	}
+
+	state, err := LoadModeState()
+	if err != nil {
+		return err
+	}
+	leases := []Lease{}
+	for _, lease := range state.LiveLeases() {
+		if lease.ID != l.ID {
+			leases = append(leases, lease)
+		}
+	}
+	state.Leases = leases
+	if !dryRun {
+		if err := state.Save(); err != nil {
+			return err
+		}
+	}
+
+	if len(leases) > 0 {
+		logf("System kept unlocked, %d lease(s) still active.\n", len(leases))
+		return nil
+	}
+
+	if state.Window != nil && state.Window.Remaining() > 0 {
+		logln("System kept unlocked until the read-write window expires.")
+		return nil
+	}
+
+	return relockLeasePaths(state, opts)
+}
+
+/*
+ReapLeases drops the leases left by dead processes, e.g. almost run being
+killed, and locks the system again if no live lease is left and no
+read-write window is open.
+*/
+func ReapLeases(opts TransitionOptions) error {
+	unlockOperation, err := LockOperation()
+	if err != nil {
+		return err
+	}
+	defer unlockOperation()
+
+	state, reaped, err := reapLeases()
+	if err != nil || reaped == 0 {
+		return err
+	}
+
+	if len(state.Leases) > 0 || (state.Window != nil && state.Window.Remaining() > 0) {
+		return nil
+	}
+
+	if opts.Reason == "" {
+		opts.Reason = "leases of dead processes reaped"
+	}
+	return relockLeasePaths(state, opts)
+}
+
+// readOnlyPaths returns the selected managed paths which are not
+// read-write
+func readOnlyPaths(state ModeState, selectors []string) ([]string, error) {
+	rules, err := LoadPathRules()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := rules.Select(selectors)
+	if err != nil {
+		return nil, err
+	}
+
+	locked := []string{}
+	for _, path := range paths {
+		if state.ModeOf(path) != ModeRw {
+			locked = append(locked, path)
+		}
+	}
+	return locked, nil
+}
+
+// deferRelock makes the release of the last lease lock the selected paths
+// too, e.g. the ones of an expired read-write window
+func deferRelock(state ModeState, selectors []string) error {
+	rules, err := LoadPathRules()
+	if err != nil {
+		return err
+	}
+	paths, err := rules.Select(selectors)
+	if err != nil {
+		return err
+	}
+
+	state.LeasePaths = appendMissing(state.LeasePaths, paths)
+	if dryRun {
+		return nil
+	}
+	return state.Save()
+}
+
+// relockLeasePaths locks the paths unlocked by the leases again, once the
+// last one is gone
+func relockLeasePaths(state ModeState, opts TransitionOptions) error {
+	rules, err := LoadPathRules()
+	if err != nil {
+		return err
+	}
+
+	// paths may have left the managed ones meanwhile
+	managed := map[string]bool{}
+	for _, path := range rules.Resolve() {
+		managed[path] = true
+	}
+	paths := []string{}
+	for _, path := range state.LeasePaths {
+		if managed[path] {
+			paths = append(paths, path)
+		}
+	}
+
+	if len(paths) > 0 {
+		opts.Paths = paths
+		if err := enterMode(ModeRo, opts); err != nil {
+			return err
+		}
+	} else {
+		logln("Nothing to lock again, the paths were read-write before the leases.")
+	}
+	if dryRun {
+		return nil
+	}
+
+	// the transition updated the state
+	state, err = LoadModeState()
+	if err != nil {
+		return err
+	}
+	state.LeasePaths = nil
+	return state.Save()
+}
+
+// appendMissing appends the paths which are not in the list yet
+func appendMissing(list []string, paths []string) []string {
+	for _, path := range paths {
+		found := false
+		for _, item := range list {
+			if item == path {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, path)
+		}
+	}
+	return list
+}
+
+// reapLeases drops the leases of dead processes from the state, returning
+// the state left and how many were dropped, the caller holds the operation
+// lock
+func reapLeases() (ModeState, int, error) {
+	state, err := LoadModeState()
+	if err != nil {
+		return state, 0, err
+	}
+
+	leases := state.LiveLeases()
+	reaped := len(state.Leases) - len(leases)
+	if reaped == 0 {
+		return state, 0, nil
+	}
+
+	state.Leases = leases
+	if dryRun {
+		logf("Would drop %d lease(s) left by dead processes.\n", reaped)
+		return state, reaped, nil
+	}
+	if err := state.Save(); err != nil {
+		return state, 0, err
+	}
+
+	logf("Dropped %d lease(s) left by dead processes.\n", reaped)
+	return state, reaped, nil
+}
+
+/*
+ListLeases returns the live leases, the ones left by dead processes are
+dropped from the state by ReapLeases and the next lease change.
+*/
+func ListLeases() ([]Lease, error) {
+	state, err := LoadModeState()
+	if err != nil {
+		return nil, err
+	}
+
+	return state.LiveLeases(), nil
+}
+
+// processStartTime returns the start time of a process, field 22 of
+// /proc/<pid>/stat
+func processStartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	startTime, err := parseStartTime(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("malformed stat of process %d", pid)
+	}
+	return startTime, nil
+}
+
+// parseStartTime extracts the start time from the content of a stat file
+func parseStartTime(stat string) (uint64, error) {
+	// the command name may contain spaces and parentheses, the fields
+	// after it start from the last closing parenthesis
+	end := strings.LastIndexByte(stat, ')')
+	if end < 0 {
+		return 0, fmt.Errorf("missing command name")
+	}
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("expected at least 22 fields")
+	}
+
+	return strconv.ParseUint(fields[19], 10, 64)
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseStartTime(t *testing.T) {
+	const rest = " R 30810 30867 30810 0 -1 4194304 82 0 0 0 0 0 0 0 20 0 1 0 499287 2703360 286 18446744073709551615 0 0 0\n"
+
+	tests := []struct {
+		stat  string
+		want  uint64
+		fails bool
+	}{
+		{stat: "30867 (cat)" + rest, want: 499287},
+		{stat: "30867 (my cmd)" + rest, want: 499287},
+		// the command name may contain a closing parenthesis followed by
+		// something looking like fields
+		{stat: "30867 (a) R 1 2 3)" + rest, want: 499287},
+		{stat: "30867 ())" + rest, want: 499287},
+		{stat: "30867 (cat R 1 2 3", fails: true},
+		{stat: "30867 (cat) R 30810 30867", fails: true},
+		{stat: "30867 (cat) R 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 start", fails: true},
+		{stat: "", fails: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseStartTime(test.stat)
+		switch {
+		case test.fails && err == nil:
+			t.Errorf("parseStartTime(%q) = %d, want an error", test.stat, got)
+		case !test.fails && err != nil:
+			t.Errorf("parseStartTime(%q): %s", test.stat, err)
+		case !test.fails && got != test.want:
+			t.Errorf("parseStartTime(%q) = %d, want %d", test.stat, got, test.want)
+		}
+	}
+}
+
+func TestProcessStartTime(t *testing.T) {
+	startTime, err := processStartTime(os.Getpid())
+	if err != nil {
+		t.Skip("no /proc:", err)
+	}
+
+	lease := Lease{Pid: os.Getpid(), StartTime: startTime}
+	if !lease.Alive() {
+		t.Error("the lease of the running process is not alive")
+	}
+
+	lease.StartTime++
+	if lease.Alive() {
+		t.Error("a lease whose pid has been reused is alive")
+	}
+}
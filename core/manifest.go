@@ -0,0 +1,343 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	manifestPath    = "/etc/almost/manifest"
+	manifestSigPath = "/etc/almost/manifest.sig"
+	manifestKeyPath = "/etc/almost/manifest.key"
+	manifestPubPath = "/etc/almost/manifest.pub"
+)
+
+/*
+ManifestEntry describes a file under the managed paths. Hash is the
+SHA-256 of the content for regular files, of the target for symlinks and
+empty for everything else.
+*/
+type ManifestEntry struct {
+	Mode fs.FileMode
+	Uid  uint32
+	Gid  uint32
+	Size int64
+	Hash string
+}
+
+/*
+Manifest maps every file under the managed paths to its entry.
+*/
+type Manifest map[string]ManifestEntry
+
+/*
+IntegrityReport lists the differences between the manifest saved by the
+last lock and the current content of the managed paths.
+*/
+type IntegrityReport struct {
+	SignatureValid bool     `json:"signature_valid"`
+	Added          []string `json:"added"`
+	Removed        []string `json:"removed"`
+	Modified       []string `json:"modified"`
+	Failures       []string `json:"failures"`
+}
+
+/*
+Clean checks whether nothing changed since the manifest was saved.
+*/
+func (r IntegrityReport) Clean() bool {
+	return r.SignatureValid && len(r.Added) == 0 && len(r.Removed) == 0 &&
+		len(r.Modified) == 0 && len(r.Failures) == 0
+}
+
+/*
+BuildManifest walks the managed paths and describes every file found.
+*/
+func BuildManifest(rules PathRules) (Manifest, []FileError) {
+	manifest := Manifest{}
+	failures := []FileError{}
+
+	opts := rules.WalkOptions()
+	opts.Special = true
+
+	for _, root := range rules.Resolve() {
+		summary, err := Walk(root, opts, func(path string, d fs.DirEntry) (bool, error) {
+			entry, err := newManifestEntry(path)
+			if err != nil {
+				return false, err
+			}
+			manifest[unrooted(path)] = entry
+			return false, nil
+		})
+		if err != nil {
+			summary.fail(root, err)
+		}
+		failures = append(failures, summary.Failures...)
+	}
+
+	return manifest, failures
+}
+
+func newManifestEntry(path string) (ManifestEntry, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+
+	entry := ManifestEntry{Mode: info.Mode(), Size: info.Size()}
+	// the size of a directory depends on the entries it ever held, the
+	// changes of its content are reported by the entries themselves
+	if info.IsDir() {
+		entry.Size = 0
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.Uid = st.Uid
+		entry.Gid = st.Gid
+	}
+
+	switch {
+	case info.Mode().IsRegular():
+		f, err := os.Open(path)
+		if err != nil {
+			return entry, err
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return entry, err
+		}
+		entry.Hash = hex.EncodeToString(h.Sum(nil))
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return entry, err
+		}
+		sum := sha256.Sum256([]byte(target))
+		entry.Hash = hex.EncodeToString(sum[:])
+	}
+
+	return entry, nil
+}
+
+/*
+WriteManifest builds the manifest of the managed paths and saves it, signed
+with the local key which is generated on first use.
+*/
+func WriteManifest(rules PathRules) error {
+	manifest, failures := BuildManifest(rules)
+	for _, failure := range failures {
+		logln("Manifest: skipping", failure.Error())
+	}
+
+	data := manifest.encode()
+
+	key, err := manifestKey()
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(data)
+	sig := ed25519.Sign(key, digest[:])
+
+	if err := writeFileAtomic(manifestPath, data, 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(manifestSigPath, []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0600)
+}
+
+/*
+LoadManifest reads the saved manifest and checks its signature, the
+manifest is returned even if the signature does not match.
+*/
+func LoadManifest() (Manifest, bool, error) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, fmt.Errorf("no manifest found, enable Almost::IntegrityManifest and lock the system first")
+		}
+		return nil, false, err
+	}
+
+	manifest, err := decodeManifest(data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return manifest, manifestSignatureValid(data), nil
+}
+
+/*
+VerifyIntegrity compares the saved manifest with the current content of the
+managed paths.
+*/
+func VerifyIntegrity() (IntegrityReport, error) {
+	report := IntegrityReport{
+		Added:    []string{},
+		Removed:  []string{},
+		Modified: []string{},
+		Failures: []string{},
+	}
+
+	saved, valid, err := LoadManifest()
+	if err != nil {
+		return report, err
+	}
+	report.SignatureValid = valid
+
+	rules, err := LoadPathRules()
+	if err != nil {
+		return report, err
+	}
+
+	current, failures := BuildManifest(rules)
+	for _, failure := range failures {
+		report.Failures = append(report.Failures, failure.Error())
+	}
+
+	for path, entry := range current {
+		savedEntry, ok := saved[path]
+		switch {
+		case !ok:
+			report.Added = append(report.Added, path)
+		case savedEntry != entry:
+			report.Modified = append(report.Modified, path)
+		}
+	}
+	for path := range saved {
+		if _, ok := current[path]; !ok {
+			report.Removed = append(report.Removed, path)
+		}
+	}
+
+	sort.Strings(report.Added)
+	sort.Strings(report.Removed)
+	sort.Strings(report.Modified)
+
+	return report, nil
+}
+
+// encode serializes the manifest, one line per file sorted by path:
+// hash mode uid gid size "path"
+func (m Manifest) encode() []byte {
+	paths := make([]string, 0, len(m))
+	for path := range m {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	for _, path := range paths {
+		entry := m[path]
+		hash := entry.Hash
+		if hash == "" {
+			hash = "-"
+		}
+		fmt.Fprintf(&buf, "%s\t%o\t%d\t%d\t%d\t%s\n",
+			hash, uint32(entry.Mode), entry.Uid, entry.Gid, entry.Size, strconv.Quote(path))
+	}
+
+	return buf.Bytes()
+}
+
+func decodeManifest(data []byte) (Manifest, error) {
+	manifest := Manifest{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		fields := strings.SplitN(scanner.Text(), "\t", 6)
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("malformed manifest at line %d", lineNo)
+		}
+
+		mode, err1 := strconv.ParseUint(fields[1], 8, 32)
+		uid, err2 := strconv.ParseUint(fields[2], 10, 32)
+		gid, err3 := strconv.ParseUint(fields[3], 10, 32)
+		size, err4 := strconv.ParseInt(fields[4], 10, 64)
+		path, err5 := strconv.Unquote(fields[5])
+		for _, err := range []error{err1, err2, err3, err4, err5} {
+			if err != nil {
+				return nil, fmt.Errorf("malformed manifest at line %d: %s", lineNo, err)
+			}
+		}
+
+		entry := ManifestEntry{
+			Mode: fs.FileMode(mode),
+			Uid:  uint32(uid),
+			Gid:  uint32(gid),
+			Size: size,
+		}
+		if fields[0] != "-" {
+			entry.Hash = fields[0]
+		}
+		manifest[path] = entry
+	}
+
+	return manifest, scanner.Err()
+}
+
+func manifestSignatureValid(data []byte) bool {
+	encodedSig, err := os.ReadFile(manifestSigPath)
+	if err != nil {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encodedSig)))
+	if err != nil {
+		return false
+	}
+
+	encodedPub, err := os.ReadFile(manifestPubPath)
+	if err != nil {
+		return false
+	}
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encodedPub)))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+
+	digest := sha256.Sum256(data)
+	return ed25519.Verify(ed25519.PublicKey(pub), digest[:], sig)
+}
+
+// manifestKey returns the private key signing the manifest, generating the
+// key pair if missing
+func manifestKey() (ed25519.PrivateKey, error) {
+	encoded, err := os.ReadFile(manifestKeyPath)
+	if err == nil {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil || len(key) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("malformed manifest key %s", manifestKeyPath)
+		}
+		return ed25519.PrivateKey(key), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(manifestKeyPath, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(manifestPubPath, []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	manifest := Manifest{
+		"/usr/bin/ls": {
+			Mode: 0755,
+			Size: 142144,
+			Hash: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		},
+		"/usr/bin":              {Mode: fs.ModeDir | 0755},
+		"/usr/lib/libc.so":      {Mode: fs.ModeSymlink | 0777, Size: 9, Hash: "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"},
+		"/usr/share/with space": {Mode: 0644, Uid: 1000, Gid: 100},
+		"/usr/share/with\ttab":  {Mode: 0644},
+		"/usr/share/new\nline":  {Mode: 0644},
+		"/usr/share/\"quoted\"": {Mode: 0600},
+		"/usr/share/ünïcode":    {Mode: fs.ModeSetuid | 0755},
+		"/usr/share/device":     {Mode: fs.ModeDevice | fs.ModeCharDevice | 0666},
+		"/usr/share/fifo":       {Mode: fs.ModeNamedPipe | 0644},
+	}
+
+	data := manifest.encode()
+	if lines := strings.Count(string(data), "\n"); lines != len(manifest) {
+		t.Errorf("encoded %d lines, want %d", lines, len(manifest))
+	}
+
+	decoded, err := decodeManifest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, manifest) {
+		t.Errorf("decoded %v, want %v", decoded, manifest)
+	}
+
+	// the encoding is stable, it is what the signature covers
+	if again := decoded.encode(); string(again) != string(data) {
+		t.Errorf("encoded again as\n%s\nwant\n%s", again, data)
+	}
+}
+
+func TestDecodeManifestMalformed(t *testing.T) {
+	for _, line := range []string{
+		"-\t644\t0\t0\t0",
+		"-\t999\t0\t0\t0\t\"/usr\"",
+		"-\t644\troot\t0\t0\t\"/usr\"",
+		"-\t644\t0\t0\t0\t/usr",
+	} {
+		if _, err := decodeManifest([]byte(line + "\n")); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+}
+
+func TestNewManifestEntry(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("almost\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := newManifestEntry(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ManifestEntry{Mode: 0640, Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid()), Size: 7, Hash: sha256Hex("almost\n")}
+	if entry != want {
+		t.Errorf("file entry %+v, want %+v", entry, want)
+	}
+
+	entry, err = newManifestEntry(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Hash != sha256Hex("file") || entry.Mode&fs.ModeSymlink == 0 {
+		t.Errorf("symlink entry %+v, want the hash of its target", entry)
+	}
+
+	entry, err = newManifestEntry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Size != 0 || entry.Hash != "" || !entry.Mode.IsDir() {
+		t.Errorf("directory entry %+v, want no size and no hash", entry)
+	}
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
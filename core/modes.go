@@ -0,0 +1,209 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	// the runtime state lives in a tmpfs so it never outlives the mounts
+	// and attributes it describes, at boot almost.service enters the
+	// default mode again
+	runtimeDir = "/run/almost"
+	statePath  = "/run/almost/state.json"
+)
+
+/*
+ModeState holds the runtime state of almost: the current mode of every
+managed path, the open read-write window and the live leases, if any, with
+the paths they unlocked, the read-only bind mounts made by almost and the
+last transition.
+*/
+type ModeState struct {
+	Paths  map[string]string `json:"paths"`
+	Window *Window           `json:"window,omitempty"`
+	Mounts map[string]bool   `json:"mounts,omitempty"`
+	Leases []Lease           `json:"leases,omitempty"`
+	// LeasePaths holds the managed paths unlocked by the leases, they are
+	// locked again once the last lease is released
+	LeasePaths     []string    `json:"lease_paths,omitempty"`
+	LastTransition *Transition `json:"last_transition,omitempty"`
+
+	// probed caches the modes read from the backends of the paths which
+	// have not been toggled since boot
+	probed map[string]string
+}
+
+/*
+Transition records when and why the mode of some managed paths was
+changed, Failed counts the files which could not be processed.
+*/
+type Transition struct {
+	Time   time.Time `json:"time"`
+	Mode   string    `json:"mode"`
+	Paths  []string  `json:"paths"`
+	Reason string    `json:"reason"`
+	Failed int       `json:"failed,omitempty"`
+}
+
+/*
+ParseMode returns the mode with the given name, ro or rw.
+*/
+func ParseMode(name string) (string, error) {
+	switch name {
+	case "ro", ModeRo:
+		return ModeRo, nil
+	case "rw", ModeRw:
+		return ModeRw, nil
+	default:
+		return "", fmt.Errorf("unknown mode: %s", name)
+	}
+}
+
+/*
+ModeName returns the readable name of a mode.
+*/
+func ModeName(mode string) string {
+	switch mode {
+	case ModeRo:
+		return "ro"
+	case ModeRw:
+		return "rw"
+	default:
+		return "mixed"
+	}
+}
+
+/*
+LoadModeState reads the runtime state from /run/almost/state.json.
+*/
+func LoadModeState() (ModeState, error) {
+	state := ModeState{Paths: map[string]string{}, probed: map[string]string{}}
+
+	data, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("malformed %s: %s", statePath, err)
+	}
+	if state.Paths == nil {
+		state.Paths = map[string]string{}
+	}
+
+	return state, nil
+}
+
+/*
+Save writes the runtime state.
+*/
+func (s ModeState) Save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(statePath, data, 0644)
+}
+
+/*
+ModeOf returns the current mode of a managed path. The mode of the paths
+which have not been toggled since boot is read from their backend, e.g.
+the immutable flags left by the previous boot if Almost::PersistModeStatus
+is off.
+*/
+func (s ModeState) ModeOf(path string) string {
+	if mode, ok := s.Paths[path]; ok {
+		return mode
+	}
+	if mode, ok := s.probed[path]; ok {
+		return mode
+	}
+
+	mode, err := s.probeMode(path)
+	if err != nil {
+		// nothing to probe, e.g. the path does not exist yet
+		mode = GetMode("Almost::DefaultMode")
+	}
+	if s.probed != nil {
+		s.probed[path] = mode
+	}
+	return mode
+}
+
+// probeMode asks the backend of a path whether it is protected
+func (s ModeState) probeMode(path string) (string, error) {
+	rules, err := LoadPathRules()
+	if err != nil {
+		return "", err
+	}
+
+	backend, _, err := rules.BackendFor(path, &BackendContext{Rules: rules, State: &s})
+	if err != nil {
+		return "", err
+	}
+
+	protected, err := backend.Status(path)
+	if err != nil {
+		return "", err
+	}
+	if protected {
+		return ModeRo, nil
+	}
+	return ModeRw, nil
+}
+
+/*
+LiveLeases returns the leases whose process is still running.
+*/
+func (s ModeState) LiveLeases() []Lease {
+	leases := []Lease{}
+	for _, lease := range s.Leases {
+		if lease.Alive() {
+			leases = append(leases, lease)
+		}
+	}
+	return leases
+}
+
+/*
+Current returns the mode of the given paths as a whole, ModeMixed if they
+are not all in the same mode.
+*/
+func (s ModeState) Current(paths []string) string {
+	current := ""
+	for _, path := range paths {
+		mode := s.ModeOf(path)
+		if current != "" && mode != current {
+			return ModeMixed
+		}
+		current = mode
+	}
+
+	if current == "" {
+		return ModeRo
+	}
+	return current
+}
+
+/*
+CurrentMode returns the mode of the managed paths as a whole.
+*/
+func CurrentMode() (string, error) {
+	rules, err := LoadPathRules()
+	if err != nil {
+		return "", err
+	}
+	state, err := LoadModeState()
+	if err != nil {
+		return "", err
+	}
+
+	return state.Current(rules.Resolve()), nil
+}
@@ -4,29 +4,55 @@ import (
 	"os/exec"
 )
 
-func OfflineUpdate() error {
-	if err := OverlayAdd("/usr", true, true); err != nil {
+func OfflineUpdate() (err error) {
+	if err := requireLiveSystem("offline-update"); err != nil {
 		return err
 	}
 
-	EnterRw(true)
+	unlock, err := LockOperation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if dryRun {
+		return previewOfflineUpdate()
+	}
+
+	if err := overlayAdd("/usr", true, false, true); err != nil {
+		return err
+	}
+
+	lease, err := acquireLease("offline-update", TransitionOptions{Verbose: true, OnFailure: FailureRollback})
+	if err != nil {
+		return joinErrors(err, overlayRemove("/usr", false, true))
+	}
+	// the lease is released whatever happens to the overlay, so that the
+	// system is locked again
+	defer func() {
+		err = joinErrors(err, lease.release(TransitionOptions{Verbose: true, OnFailure: FailureRetry}))
+	}()
 
 	// TODO: this should be done in a more elegant way, using a persistent
 	// overlay and fstab entries
 
 	cmd := exec.Command("/usr/libexec/pk-offline-update")
 	if err := cmd.Run(); err != nil {
-		if err := OverlayRemove("/usr", false, true); err != nil {
-			return err
-		}
-		return err
+		return joinErrors(err, overlayRemove("/usr", false, true))
 	}
 
-	if err := OverlayRemove("/usr", true, true); err != nil {
+	return overlayRemove("/usr", true, true)
+}
+
+func previewOfflineUpdate() error {
+	if err := overlayAdd("/usr", true, false, true); err != nil {
+		return err
+	}
+	if err := enterMode(ModeRw, TransitionOptions{Verbose: true}); err != nil {
 		return err
 	}
 
-	EnterRo(true)
-
+	logln("Would run /usr/libexec/pk-offline-update")
+	logln("Would commit the overlay on /usr and lock the system again")
 	return nil
 }
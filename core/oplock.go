@@ -0,0 +1,162 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var opLockPath = "/run/almost/almost.lock"
+
+// opLock is the exclusive lock serializing the mutating operations: held
+// is taken by the operation running in this process and the lock file
+// keeps out the other processes. It is not reentrant, the operations call
+// each other through unexported variants expecting the lock to be held.
+var opLock = struct {
+	held chan struct{}
+	// mutex guards wait
+	mutex sync.Mutex
+	wait  time.Duration
+}{held: make(chan struct{}, 1)}
+
+/*
+SetLockWait sets how long operations wait for the one running, in this
+process or in another one, to finish, by default they fail right away.
+*/
+func SetLockWait(wait time.Duration) {
+	opLock.mutex.Lock()
+	defer opLock.mutex.Unlock()
+
+	opLock.wait = wait
+}
+
+func lockWait() time.Duration {
+	opLock.mutex.Lock()
+	defer opLock.mutex.Unlock()
+
+	return opLock.wait
+}
+
+/*
+LockOperation takes the global lock serializing the almost operations
+changing the system, the returned function releases it. If another
+operation holds the lock, in this process or in another one, it fails
+reporting the holder once the time set with SetLockWait has elapsed. The
+lock is not reentrant, the operations take it themselves.
+*/
+func LockOperation() (func(), error) {
+	wait := lockWait()
+	deadline := time.Now().Add(wait)
+
+	if !takeHeld(deadline) {
+		return nil, lockBusy(wait)
+	}
+
+	f, err := lockFile(wait, deadline)
+	if err != nil {
+		<-opLock.held
+		return nil, err
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			f.Truncate(0)
+			unix.Flock(int(f.Fd()), unix.LOCK_UN)
+			f.Close()
+			<-opLock.held
+		})
+	}, nil
+}
+
+// takeHeld waits for the operation running in this process, if any, until
+// the deadline
+func takeHeld(deadline time.Time) bool {
+	select {
+	case opLock.held <- struct{}{}:
+		return true
+	default:
+	}
+
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case opLock.held <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// lockFile takes the lock file, waiting for the operation running in
+// another process, if any, until the deadline
+func lockFile(wait time.Duration, deadline time.Time) (*os.File, error) {
+	if err := os.MkdirAll(runtimeDir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(opLockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	notified := false
+	for {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			f.Close()
+			return nil, err
+		}
+
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, lockBusy(wait)
+		}
+		if !notified {
+			logf("Waiting for another almost operation (%s)..\n", lockHolder())
+			notified = true
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	// the holder is recorded so that contending commands can report it
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n%s\n%s\n", os.Getpid(), strings.Join(os.Args, " "), time.Now().Format(time.RFC3339))
+	f.Sync()
+
+	return f, nil
+}
+
+func lockBusy(wait time.Duration) error {
+	holder := lockHolder()
+	if wait > 0 {
+		return fmt.Errorf("timed out waiting for another almost operation (%s)", holder)
+	}
+	return fmt.Errorf("another almost operation is in progress (%s), use --wait to wait for it", holder)
+}
+
+// lockHolder describes the process holding the lock
+func lockHolder() string {
+	data, err := os.ReadFile(opLockPath)
+	if err != nil {
+		return "unknown holder"
+	}
+
+	lines := strings.SplitN(strings.TrimSpace(string(data)), "\n", 3)
+	if len(lines) < 3 {
+		return "unknown holder"
+	}
+	return fmt.Sprintf("pid %s: %s, since %s", lines[0], lines[1], lines[2])
+}
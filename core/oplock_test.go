@@ -0,0 +1,65 @@
+package core
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockOperation(t *testing.T) {
+	dir := t.TempDir()
+	oldRuntime, oldPath, oldOutput := runtimeDir, opLockPath, output
+	runtimeDir, opLockPath, output = dir, filepath.Join(dir, "almost.lock"), io.Discard
+	defer func() {
+		runtimeDir, opLockPath, output = oldRuntime, oldPath, oldOutput
+		SetLockWait(0)
+	}()
+
+	unlock, err := LockOperation()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the lock is not reentrant, even in the same goroutine
+	if _, err := LockOperation(); err == nil {
+		t.Fatal("lock taken twice")
+	}
+
+	// a waiting operation gets the lock once released, the holder is not
+	// kept from releasing it meanwhile
+	SetLockWait(5 * time.Second)
+	locked := make(chan error)
+	go func() {
+		unlock, err := LockOperation()
+		if err == nil {
+			unlock()
+		}
+		locked <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	unlock()
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+
+	// the holder is recorded in the lock file while it is held
+	unlock, err = LockOperation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder, err := os.ReadFile(opLockPath)
+	if err != nil || len(holder) == 0 {
+		t.Errorf("holder not recorded: %q, %v", holder, err)
+	}
+	unlock()
+	unlock()
+
+	SetLockWait(100 * time.Millisecond)
+	unlock, err = LockOperation()
+	if err != nil {
+		t.Fatalf("lock not released: %s", err)
+	}
+	unlock()
+}
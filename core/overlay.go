@@ -3,7 +3,10 @@ package core
 import (
 	"database/sql"
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,268 +18,406 @@ import (
 var (
 	overlaysPath   = "/etc/almost/overlays"
 	overlaysDbPath = "/etc/almost/overlays.db"
+	// overlayUnitsDir holds the mount units of the persistent overlays
+	overlayUnitsDir = "/etc/systemd/system"
 )
 
-func init() {
-	if !RootCheck(false) {
-		return
+// openOverlaysDb opens the overlays database, creating it on first use
+func openOverlaysDb() (*sql.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(overlaysDbPath), 0755); err != nil {
+		return nil, err
 	}
 
-	if _, err := os.Stat(overlaysPath); os.IsNotExist(err) {
-		os.Mkdir(overlaysPath, 0755)
+	db, err := sql.Open("sqlite3", overlaysDbPath)
+	if err != nil {
+		return nil, err
 	}
 
-	if _, err := os.Stat(overlaysDbPath); os.IsNotExist(err) {
-		db, err := sql.Open("sqlite3", overlaysDbPath)
-		if err != nil {
-			panic(err)
-		}
-		initDb(db)
-		defer db.Close()
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS overlays (original TEXT NOT NULL PRIMARY KEY, workdir TEXT, timestamp TEXT, persist INTEGER DEFAULT 0);
+	`
+	if _, err := db.Exec(sqlStmt); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize the overlays db: %w", err)
 	}
 
-	removeOrphanOverlays()
+	return db, nil
 }
 
-func initDb(db *sql.DB) {
-	sqlStmt := `
-	CREATE TABLE overlays (original TEXT NOT NULL PRIMARY KEY, workdir TEXT, timestamp TEXT, persist INTEGER DEFAULT 0);
-	`
-	_, err := db.Exec(sqlStmt)
+/*
+OverlayAdd mounts a writable overlay on the given path, the changes made
+there are kept apart until the overlay is committed or discarded. A
+persistent overlay is mounted again at boot by a mount unit, the others
+are gone after a reboot.
+*/
+func OverlayAdd(path string, force bool, persist bool, verbose bool) error {
+	if err := requireLiveSystem("overlay"); err != nil {
+		return err
+	}
+
+	unlock, err := LockOperation()
 	if err != nil {
-		fmt.Println("failed to initialize the overlays db: ", err)
-		os.Exit(1)
+		return err
 	}
+	defer unlock()
+
+	return overlayAdd(path, force, persist, verbose)
 }
 
-func OverlayAdd(path string, force bool, verbose bool) error {
+// overlayAdd mounts the overlay, the caller holds the operation lock
+func overlayAdd(path string, force bool, persist bool, verbose bool) error {
+	if err := removeOrphanOverlays(); err != nil {
+		return err
+	}
+
 	// first we need to check if the given path exists, to avoid overlaying
 	// non-existing directories which is not the desired behaviour
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return fmt.Errorf("path %s does not exist", path)
 	}
 
+	// the mount unit of a persistent overlay is named after its path
+	if persist {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("the path of a persistent overlay must be absolute")
+		}
+		path = filepath.Clean(path)
+	}
+
 	// now we need to check if the path is already overlayed if it is, we
 	// need to check if the force flag is set to allow overwriting the
 	// existing overlay
-	if overlayCheck(path, verbose) && !force {
+	overlayed, err := overlayCheck(path, verbose)
+	if err != nil {
+		return err
+	}
+	if overlayed && !force {
 		return fmt.Errorf("path %s is already overlayed, remove it first", path)
 	}
+	previous := Overlay{}
+	if overlayed {
+		if previous, err = getOverlay(path, verbose); err != nil {
+			return err
+		}
+	}
+
+	unitName := overlayUnitName(path)
+	unitPath := filepath.Join(overlayUnitsDir, unitName)
+	if persist && !previous.Persist {
+		// units made by others, e.g. the one mounting the states, are
+		// never replaced
+		if _, err := os.Stat(unitPath); err == nil {
+			return fmt.Errorf("%s already exists, %s cannot be overlayed persistently", unitPath, path)
+		}
+	}
+
+	// the replaced overlay is discarded first, its layers and its mount
+	// unit would be left behind otherwise
+	if overlayed {
+		if err := overlayRemove(path, false, verbose); err != nil {
+			return fmt.Errorf("error removing the existing overlay: %w", err)
+		}
+	}
 
 	// now we need to create a temporary directory where we will store the
 	// overlay structure
 	workDir := fmt.Sprintf("%s/%s", overlaysPath, uuid.New().String())
-	if err := os.Mkdir(workDir, 0755); err != nil {
-		fmt.Println("Error creating temporary directory:", err)
-		return err
+	if dryRun {
+		logf("Would create the overlay directories in %s\n", workDir)
+		logf("Would mount overlay on %s (lowerdir=%s,upperdir=%s/upper,workdir=%s/work)\n", path, path, workDir, workDir)
+		logf("Would register the overlay of %s\n", path)
+		if persist {
+			logf("Would write %s and enable %s:\n%s\n", unitPath, unitName, overlayUnit(path, workDir))
+		}
+		return nil
+	}
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return fmt.Errorf("error creating temporary directory: %w", err)
 	}
 
 	for _, dir := range []string{"upper", "lower", "work"} {
 		if err := os.MkdirAll(fmt.Sprintf("%s/%s", workDir, dir), 0755); err != nil {
-			fmt.Println("Error creating", dir, "directory:", err)
-			return err
+			return fmt.Errorf("error creating %s directory: %w", dir, err)
 		}
 	}
 
 	// here is where the overlay magic happens, we are going to mount the
 	// temporary directory to the original one
 	if err := unix.Mount("overlay", path, "overlay", 0, fmt.Sprintf("lowerdir=%s,upperdir=%s/upper,workdir=%s/work", path, workDir, workDir)); err != nil {
-		fmt.Println("Error mounting overlay:", err)
-		return err
+		return fmt.Errorf("error mounting overlay: %w", err)
 	}
 
 	// now we need to add the overlay information to the database so that we
 	// can remove it later
-	registerOverlay(path, workDir, verbose)
+	if err := registerOverlay(path, workDir, persist, verbose); err != nil {
+		return err
+	}
 
-	fmt.Printf("Your new overlay is ready at %s\n", path)
+	if persist {
+		if err := writeOverlayUnit(path, workDir); err != nil {
+			removeOverlayUnit(path)
+			registerOverlay(path, workDir, false, verbose)
+			return fmt.Errorf("error making the overlay persistent, it is mounted until reboot: %w", err)
+		}
+		logf("Your new overlay is ready at %s and will be mounted at boot\n", path)
+		return nil
+	}
+
+	logf("Your new overlay is ready at %s\n", path)
 
 	return nil
 }
 
 func OverlayRemove(path string, keep bool, verbose bool) error {
+	if err := requireLiveSystem("overlay"); err != nil {
+		return err
+	}
+
+	unlock, err := LockOperation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return overlayRemove(path, keep, verbose)
+}
+
+// overlayRemove commits or discards the overlay, the caller holds the
+// operation lock
+func overlayRemove(path string, keep bool, verbose bool) (err error) {
+	if err := removeOrphanOverlays(); err != nil {
+		return err
+	}
+
 	// first we need to check if the given has an overlay
-	if !overlayCheck(path, verbose) {
+	overlayed, err := overlayCheck(path, verbose)
+	if err != nil {
+		return err
+	}
+	if !overlayed {
 		return fmt.Errorf("path %s is not overlayed", path)
 	}
 
-	original, workDir := getOverlay(path, verbose)
+	overlay, err := getOverlay(path, verbose)
+	if err != nil {
+		return err
+	}
+	original, workDir := overlay.Path, overlay.WorkDir
+
+	event := HookOverlayDiscard
+	if keep {
+		event = HookOverlayCommit
+	}
+	env := HookEnv{"OVERLAY_PATH": original, "OVERLAY_WORKDIR": workDir}
+	if err := RunPreHooks(event, env); err != nil {
+		return err
+	}
+	defer func() {
+		RunPostHooks(event, env, err)
+	}()
+
+	if dryRun {
+		if overlay.Persist {
+			logf("Would disable %s and remove %s\n", overlayUnitName(original), filepath.Join(overlayUnitsDir, overlayUnitName(original)))
+		}
+		return previewOverlayRemove(path, original, workDir, keep)
+	}
+
+	// the overlay must not come back at boot, whatever happens next
+	if overlay.Persist {
+		if err := removeOverlayUnit(original); err != nil {
+			return fmt.Errorf("error removing the overlay mount unit: %w", err)
+		}
+	}
 
 	// then unmount the overlay
 	if err := unix.Unmount(path, 0); err != nil {
-		fmt.Println("The resource is busy, re-trying terminating all processes using it..")
+		logln("The resource is busy, re-trying terminating all processes using it..")
 		if err := unix.Unmount(path, unix.MNT_DETACH); err != nil {
-			fmt.Println("Error unmounting overlay:", err)
-			return err
+			return fmt.Errorf("error unmounting overlay: %w", err)
 		}
 	}
 
 	// remove it from the internal database
-	removeOverlay(path, verbose)
+	if err := removeOverlay(path, verbose); err != nil {
+		return err
+	}
 
 	// if the keep flag is set, we need to merge the upper and lower
 	// directories and copy them to the original path
 	if keep {
 		if err := copy.Copy(fmt.Sprintf("%s/upper", workDir), original); err != nil {
-			fmt.Println("Error copying overlay to original path:", err)
-			return err
+			return fmt.Errorf("error copying overlay to original path: %w", err)
 		}
 	}
 
 	// finally we need to remove the temporary directory
 	if err := os.RemoveAll(workDir); err != nil {
-		fmt.Println("Error removing temporary directory:", err)
-		return err
+		return fmt.Errorf("error removing temporary directory: %w", err)
 	}
 
-	fmt.Printf("Overlay at %s removed\n", path)
+	logf("Overlay at %s removed\n", path)
 
 	return nil
 }
 
-func OverlayList() map[string]string {
-	overlays := make(map[string]string)
+func previewOverlayRemove(path, original, workDir string, keep bool) error {
+	logf("Would unmount the overlay on %s\n", path)
+	logf("Would unregister the overlay of %s\n", path)
 
-	db, err := sql.Open("sqlite3", overlaysDbPath)
+	if keep {
+		upper := fmt.Sprintf("%s/upper", workDir)
+		err := filepath.WalkDir(upper, func(file string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if file == upper {
+				return nil
+			}
+			rel, _ := filepath.Rel(upper, file)
+			logf("Would copy %s to %s\n", rel, filepath.Join(original, rel))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	logf("Would remove %s\n", workDir)
+	return nil
+}
+
+/*
+Overlay describes a registered overlay, WorkDir holds its layers. A
+persistent overlay is mounted at boot by its own mount unit.
+*/
+type Overlay struct {
+	Path    string
+	WorkDir string
+	Created time.Time
+	Persist bool
+}
+
+/*
+OverlayList returns the registered overlays, sorted by path.
+*/
+func OverlayList() ([]Overlay, error) {
+	overlays := []Overlay{}
+
+	// nothing has been overlayed yet
+	if _, err := os.Stat(overlaysDbPath); os.IsNotExist(err) {
+		return overlays, nil
+	}
+
+	db, err := openOverlaysDb()
 	if err != nil {
-		fmt.Println(err)
-		return overlays
+		return overlays, err
 	}
 	defer db.Close()
 
-	rows, err := db.Query("SELECT original, workdir FROM overlays")
+	rows, err := db.Query("SELECT original, workdir, timestamp, persist FROM overlays ORDER BY original")
 	if err != nil {
-		fmt.Println(err)
-		return overlays
+		return overlays, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var original, workdir string
-		if err := rows.Scan(&original, &workdir); err != nil {
-			fmt.Println(err)
-			return overlays
+		overlay, err := scanOverlay(rows)
+		if err != nil {
+			return overlays, err
 		}
-		overlays[original] = workdir
+		overlays = append(overlays, overlay)
 	}
-	if err := rows.Err(); err != nil {
-		fmt.Println(err)
-		return overlays
+
+	return overlays, rows.Err()
+}
+
+func scanOverlay(row interface{ Scan(...interface{}) error }) (Overlay, error) {
+	var overlay Overlay
+	var timestamp sql.NullString
+	var persist sql.NullInt64
+	if err := row.Scan(&overlay.Path, &overlay.WorkDir, &timestamp, &persist); err != nil {
+		return overlay, err
 	}
 
-	return overlays
+	overlay.Created, _ = time.Parse(time.RFC3339, timestamp.String)
+	overlay.Persist = persist.Int64 != 0
+	return overlay, nil
 }
 
-func overlayCheck(path string, verbose bool) bool {
+func overlayCheck(path string, verbose bool) (bool, error) {
 	if verbose {
-		fmt.Println("Checking if", path, "is overlayed")
+		logln("Checking if", path, "is overlayed")
 	}
 
-	db, err := sql.Open("sqlite3", overlaysDbPath)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	// nothing has been overlayed yet, the database is not created here
+	// since dry runs check too
+	if _, err := os.Stat(overlaysDbPath); os.IsNotExist(err) {
+		return false, nil
 	}
-	defer db.Close()
 
-	stmt, err := db.Prepare("SELECT * FROM overlays WHERE original = ?")
+	db, err := openOverlaysDb()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return false, err
 	}
+	defer db.Close()
 
 	var original string
-	var workdir string
-	var timestamp string
-	var persist int
-	err = stmt.QueryRow(path).Scan(&original, &workdir, &timestamp, &persist)
-	return err == nil
+	err = db.QueryRow("SELECT original FROM overlays WHERE original = ?", path).Scan(&original)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
 }
 
-func getOverlay(path string, verbose bool) (string, string) {
+func getOverlay(path string, verbose bool) (Overlay, error) {
 	if verbose {
-		fmt.Println("Getting overlay information for:", path)
+		logln("Getting overlay information for:", path)
 	}
 
-	db, err := sql.Open("sqlite3", overlaysDbPath)
+	db, err := openOverlaysDb()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return Overlay{}, err
 	}
 	defer db.Close()
 
-	stmt, err := db.Prepare("SELECT original, workdir FROM overlays WHERE original = ?")
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-	defer stmt.Close()
-
-	var original, workDir string
-	err = stmt.QueryRow(path).Scan(&original, &workDir)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	return original, workDir
+	row := db.QueryRow("SELECT original, workdir, timestamp, persist FROM overlays WHERE original = ?", path)
+	return scanOverlay(row)
 }
 
-func registerOverlay(path, workDir string, verbose bool) {
+func registerOverlay(path, workDir string, persist bool, verbose bool) error {
 	if verbose {
-		fmt.Println("Registering overlay for:", path)
+		logln("Registering overlay for:", path)
 	}
 
-	db, err := sql.Open("sqlite3", overlaysDbPath)
+	db, err := openOverlaysDb()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
 	defer db.Close()
 
-	stmt, err := db.Prepare("INSERT INTO overlays(original, workdir, timestamp) VALUES(?, ?, ?)")
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	_, err = stmt.Exec(path, workDir, time.Now().Format(time.RFC3339))
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-	defer stmt.Close()
+	_, err = db.Exec("INSERT OR REPLACE INTO overlays(original, workdir, timestamp, persist) VALUES(?, ?, ?, ?)",
+		path, workDir, time.Now().Format(time.RFC3339), persist)
+	return err
 }
 
-func removeOverlay(path string, verbose bool) {
+func removeOverlay(path string, verbose bool) error {
 	if verbose {
-		fmt.Println("Removing overlay for:", path)
+		logln("Removing overlay for:", path)
 	}
 
-	db, err := sql.Open("sqlite3", overlaysDbPath)
+	db, err := openOverlaysDb()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
 	defer db.Close()
 
-	stmt, err := db.Prepare("DELETE FROM overlays WHERE original = ?")
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	_, err = stmt.Exec(path)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	defer stmt.Close()
+	_, err = db.Exec("DELETE FROM overlays WHERE original = ?", path)
+	return err
 }
 
 func copyDir(src, dst string, verbose bool) error {
 	if verbose {
-		fmt.Println("Copying", src, "to", dst)
+		logln("Copying", src, "to", dst)
 	}
 
 	srcInfo, err := os.Stat(src)
@@ -296,14 +437,107 @@ func copyDir(src, dst string, verbose bool) error {
 	return nil
 }
 
+// removeOrphanOverlays unregisters the overlays whose layers are gone, they
+// are only reported in dry runs
 func removeOrphanOverlays() error {
-	overlays := OverlayList()
-	for original, workdir := range overlays {
-		if _, err := os.Stat(workdir); os.IsNotExist(err) {
-			fmt.Println("Removing orphan overlay for:", original)
-			removeOverlay(original, false)
+	overlays, err := OverlayList()
+	if err != nil {
+		return err
+	}
+
+	for _, overlay := range overlays {
+		if _, err := os.Stat(overlay.WorkDir); os.IsNotExist(err) {
+			if dryRun {
+				logln("Would remove orphan overlay for:", overlay.Path)
+				continue
+			}
+			logln("Removing orphan overlay for:", overlay.Path)
+			if overlay.Persist {
+				if err := removeOverlayUnit(overlay.Path); err != nil {
+					return err
+				}
+			}
+			if err := removeOverlay(overlay.Path, false); err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
+
+// overlayUnitName returns the name of the mount unit of a path, escaped as
+// systemd-escape --path --suffix=mount does
+func overlayUnitName(path string) string {
+	path = strings.Trim(filepath.Clean(path), "/")
+	if path == "" {
+		return "-.mount"
+	}
+
+	var name strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			name.WriteByte('-')
+		case c == '.' && i == 0:
+			fmt.Fprintf(&name, "\\x%02x", c)
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '.', c == ':':
+			name.WriteByte(c)
+		default:
+			fmt.Fprintf(&name, "\\x%02x", c)
+		}
+	}
+
+	return name.String() + ".mount"
+}
+
+func overlayUnit(path, workDir string) string {
+	return `[Unit]
+Description=Almost Overlay for ` + path + `
+Documentation=https://documentation.vanillaos.org
+After=systemd-remount-fs.service
+Wants=systemd-remount-fs.service
+RequiresMountsFor=` + workDir + `
+
+[Mount]
+What=overlay
+Where=` + path + `
+Type=overlay
+Options=lowerdir=` + path + `,upperdir=` + workDir + `/upper,workdir=` + workDir + `/work
+
+[Install]
+WantedBy=local-fs.target`
+}
+
+// writeOverlayUnit writes and enables the mount unit of a persistent
+// overlay, the overlay is already mounted so the unit is not started
+func writeOverlayUnit(path, workDir string) error {
+	name := overlayUnitName(path)
+	if err := writeFileAtomic(filepath.Join(overlayUnitsDir, name), []byte(overlayUnit(path, workDir)), 0644); err != nil {
+		return err
+	}
+
+	if err := systemctl("enable", name); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+
+// removeOverlayUnit disables and removes the mount unit of a persistent
+// overlay
+func removeOverlayUnit(path string) error {
+	name := overlayUnitName(path)
+	unitPath := filepath.Join(overlayUnitsDir, name)
+	if _, err := os.Stat(unitPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := systemctl("disable", name); err != nil {
+		return err
+	}
+	if err := os.Remove(unitPath); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
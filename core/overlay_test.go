@@ -0,0 +1,31 @@
+package core
+
+import "testing"
+
+func TestOverlayUnitName(t *testing.T) {
+	// expected names as given by systemd-escape --path --suffix=mount
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "-.mount"},
+		{"/usr/", "usr.mount"},
+		{"//usr//local/", "usr-local.mount"},
+		{"/etc/cute-path", `etc-cute\x2dpath.mount`},
+		{"/srv/-dash", `srv-\x2ddash.mount`},
+		{"/opt/my.app", "opt-my.app.mount"},
+		{"/.hidden", `\x2ehidden.mount`},
+		{"/opt/.cache", "opt-.cache.mount"},
+		{"/srv/trailing.", "srv-trailing..mount"},
+		{"/opt/with space", `opt-with\x20space.mount`},
+		{`/opt/a\b`, `opt-a\x5cb.mount`},
+		{"/a:b_c", "a:b_c.mount"},
+		{"/home/ü/ü", `home-\xc3\xbc-\xc3\xbc.mount`},
+	}
+
+	for _, test := range tests {
+		if got := overlayUnitName(test.path); got != test.want {
+			t.Errorf("overlayUnitName(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
@@ -15,38 +15,49 @@ const (
 	DBUS_OFFLINE_INTERFACE = "org.freedesktop.PackageKit.Offline"
 )
 
-func dbusConn() *dbus.Conn {
-	conn, err := dbus.ConnectSystemBus()
-	if err != nil {
-		panic(err)
-	}
+func PackageKitUpdatePrepared() (bool, error) {
+	return packageKitOfflineProperty("UpdatePrepared")
+}
 
-	return conn
+func PackageKitUpgradePrepared() (bool, error) {
+	return packageKitOfflineProperty("UpgradePrepared")
 }
 
-func PackageKitUpdatePrepared() bool {
-	conn := dbusConn()
-	defer conn.Close()
+// offlineUpdatesPrepared checks whether PackageKit prepared an offline
+// update or upgrade, it is asked on the running system only
+func offlineUpdatesPrepared() bool {
+	if rootDir != "" {
+		return false
+	}
 
-	obj := conn.Object(DBUS_NAME, DBUS_PATH)
-	val, err := obj.GetProperty(DBUS_OFFLINE_INTERFACE + "." + "UpdatePrepared")
+	updatePrepared, err := PackageKitUpdatePrepared()
 	if err != nil {
-		fmt.Println("error:", err)
-		return false // shouldn't never happen really but who knows
+		logln("Error checking for offline updates:", err)
 	}
-	return val.Value().(bool)
+	upgradePrepared, err := PackageKitUpgradePrepared()
+	if err != nil {
+		logln("Error checking for offline upgrades:", err)
+	}
+
+	return updatePrepared || upgradePrepared
 }
 
-func PackageKitUpgradePrepared() bool {
-	conn := dbusConn()
+func packageKitOfflineProperty(name string) (bool, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return false, err
+	}
 	defer conn.Close()
 
 	obj := conn.Object(DBUS_NAME, DBUS_PATH)
-	val, err := obj.GetProperty(DBUS_OFFLINE_INTERFACE + "." + "UpgradePrepared")
+	val, err := obj.GetProperty(DBUS_OFFLINE_INTERFACE + "." + name)
 	if err != nil {
-		fmt.Println("error:", err)
-		return false // ..again, should never happen
+		return false, err
 	}
 
-	return val.Value().(bool)
+	prepared, ok := val.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("unexpected type of the %s property", name)
+	}
+	return prepared, nil
 }
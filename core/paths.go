@@ -0,0 +1,396 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	pathsDropInDir      = "/etc/almost/paths.d"
+	defaultManagedPaths = []string{
+		"/bin",
+		"/lib",
+		"/lib64",
+		"/sbin",
+		"/usr",
+	}
+)
+
+/*
+PathRules holds the glob patterns used to build the list of managed paths.
+Exclude patterns always take precedence over include patterns, append
+patterns are managed too but are set append-only instead of immutable
+when the system is locked.
+*/
+type PathRules struct {
+	Include []string
+	Exclude []string
+	Append  []string
+	// Policies holds the policies in the order they are given
+	Policies []PathPolicy
+}
+
+/*
+PathPolicy holds the per-path options given in the drop-in files.
+*/
+type PathPolicy struct {
+	// Pattern is the glob pattern the policy applies to
+	Pattern string
+	// Default is the mode entered by "almost enter default", if empty the
+	// Almost::DefaultMode setting applies
+	Default string
+	// Group allows toggling several managed paths together by name
+	Group string
+	// Strategy forces how the path is protected, if empty it depends on
+	// the file system, see StrategyFor
+	Strategy Strategy
+}
+
+/*
+LoadPathRules builds the path rules starting from the built-in defaults,
+then applying the Almost::IncludePaths, Almost::ExcludePaths and
+Almost::AppendPaths settings and finally the drop-in files in
+/etc/almost/paths.d, in lexical order.
+
+Each drop-in line is made of a directive, a glob pattern and optional
+key=value options (default=ro|rw, group=name and
+strategy=chattr|bindmount|none), empty lines and lines starting with # are
+ignored:
+
+	include /opt default=rw group=vendor
+	include /boot/efi strategy=bindmount
+	exclude /usr/local
+	append /var/log/audit
+*/
+func LoadPathRules() (PathRules, error) {
+	rules := PathRules{
+		Include: append([]string{}, defaultManagedPaths...),
+	}
+
+	include, _ := Get("Almost::IncludePaths")
+	rules.Include = append(rules.Include, splitList(include)...)
+	exclude, _ := Get("Almost::ExcludePaths")
+	rules.Exclude = append(rules.Exclude, splitList(exclude)...)
+	appendOnly, _ := Get("Almost::AppendPaths")
+	rules.Append = append(rules.Append, splitList(appendOnly)...)
+
+	dropIns, err := filepath.Glob(filepath.Join(pathsDropInDir, "*.conf"))
+	if err != nil {
+		return rules, err
+	}
+	sort.Strings(dropIns)
+
+	for _, dropIn := range dropIns {
+		if err := rules.parseDropIn(dropIn); err != nil {
+			return rules, err
+		}
+	}
+
+	if rootDir != "" {
+		rules = rules.withRoot()
+	}
+	return rules, nil
+}
+
+// withRoot returns the rules with the patterns resolved below the
+// alternate root, so that they match the paths found there
+func (r PathRules) withRoot() PathRules {
+	rootAll := func(patterns []string) []string {
+		rootedPatterns := []string{}
+		for _, pattern := range patterns {
+			rootedPatterns = append(rootedPatterns, rooted(pattern))
+		}
+		return rootedPatterns
+	}
+
+	policies := []PathPolicy{}
+	for _, policy := range r.Policies {
+		policy.Pattern = rooted(policy.Pattern)
+		policies = append(policies, policy)
+	}
+
+	return PathRules{
+		Include:  rootAll(r.Include),
+		Exclude:  rootAll(r.Exclude),
+		Append:   rootAll(r.Append),
+		Policies: policies,
+	}
+}
+
+func (r *PathRules) parseDropIn(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("%s:%d: expected a directive and a pattern", path, lineNo)
+		}
+
+		pattern := filepath.Clean(fields[1])
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s:%d: invalid pattern %s: %s", path, lineNo, fields[1], err)
+		}
+
+		if len(fields) > 2 {
+			if fields[0] == "exclude" {
+				return fmt.Errorf("%s:%d: exclude does not take options", path, lineNo)
+			}
+			policy, err := parsePathPolicy(fields[2:])
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", path, lineNo, err)
+			}
+			policy.Pattern = pattern
+			r.Policies = append(r.Policies, policy)
+		}
+
+		switch fields[0] {
+		case "include":
+			r.Include = append(r.Include, pattern)
+		case "exclude":
+			r.Exclude = append(r.Exclude, pattern)
+		case "append":
+			r.Append = append(r.Append, pattern)
+		default:
+			return fmt.Errorf("%s:%d: unknown directive %s", path, lineNo, fields[0])
+		}
+	}
+
+	return scanner.Err()
+}
+
+func parsePathPolicy(options []string) (PathPolicy, error) {
+	policy := PathPolicy{}
+
+	for _, option := range options {
+		key, value, found := strings.Cut(option, "=")
+		if !found || value == "" {
+			return policy, fmt.Errorf("malformed option %s", option)
+		}
+
+		switch key {
+		case "default":
+			mode, err := ParseMode(value)
+			if err != nil {
+				return policy, err
+			}
+			policy.Default = mode
+		case "group":
+			policy.Group = value
+		case "strategy":
+			strategy, err := ParseStrategy(value)
+			if err != nil {
+				return policy, err
+			}
+			policy.Strategy = strategy
+		default:
+			return policy, fmt.Errorf("unknown option %s", key)
+		}
+	}
+
+	return policy, nil
+}
+
+/*
+Resolve expands the include patterns into the effective list of managed
+paths. Paths which do not exist, are excluded or are nested in another
+managed path on the same file system are left out, nested mount points are
+kept since the walker does not cross them. Symlinks are left out too, e.g.
+/bin on merged-/usr systems, their target is managed if it matches a
+pattern itself.
+*/
+func (r PathRules) Resolve() []string {
+	seen := map[string]bool{}
+	paths := []string{}
+
+	for _, pattern := range append(append([]string{}, r.Include...), r.Append...) {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		for _, match := range matches {
+			match = filepath.Clean(match)
+			if seen[match] || r.Excluded(match) {
+				continue
+			}
+			// the walker and the bind mounts would both follow it
+			if info, err := os.Lstat(match); err != nil || info.Mode()&os.ModeSymlink != 0 {
+				continue
+			}
+			seen[match] = true
+			paths = append(paths, match)
+		}
+	}
+
+	sort.Strings(paths)
+
+	resolved := []string{}
+	for _, path := range paths {
+		nested := false
+		for _, parent := range resolved {
+			if isSubPath(parent, path) && sameDevice(parent, path) {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			resolved = append(resolved, path)
+		}
+	}
+
+	return resolved
+}
+
+/*
+WalkOptions returns the walk options to use on the managed paths.
+*/
+func (r PathRules) WalkOptions() WalkOptions {
+	opts := DefaultWalkOptions()
+	opts.Exclude = r.Exclude
+
+	return opts
+}
+
+/*
+LockAttr returns the attribute the given path must have when the system is
+locked, FS_APPEND_FL if the path or one of its parents matches an append
+pattern, FS_IMMUTABLE_FL otherwise.
+*/
+func (r PathRules) LockAttr(path string) int32 {
+	if matchParents(r.Append, path) {
+		return FS_APPEND_FL
+	}
+	return FS_IMMUTABLE_FL
+}
+
+/*
+PolicyOf returns the policy of a managed path, the one given for the most
+specific pattern matching the path or one of its parents. If several
+patterns match the same path, the last one given wins.
+*/
+func (r PathRules) PolicyOf(path string) PathPolicy {
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		for i := len(r.Policies) - 1; i >= 0; i-- {
+			if ok, _ := filepath.Match(r.Policies[i].Pattern, p); ok {
+				return r.Policies[i]
+			}
+		}
+		if p == "/" || p == "." {
+			return PathPolicy{}
+		}
+	}
+}
+
+/*
+Select returns the managed paths matching the given selectors, each one
+being either a managed path, relative to the alternate root if any, or a
+group name. All the managed paths are
+returned if no selector is given.
+*/
+func (r PathRules) Select(selectors []string) ([]string, error) {
+	paths := r.Resolve()
+	if len(selectors) == 0 {
+		return paths, nil
+	}
+
+	selected := []string{}
+	seen := map[string]bool{}
+	for _, selector := range selectors {
+		found := false
+		for _, path := range paths {
+			if path == rooted(filepath.Clean(selector)) || r.PolicyOf(path).Group == selector {
+				found = true
+				if !seen[path] {
+					seen[path] = true
+					selected = append(selected, path)
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s is not a managed path or group", selector)
+		}
+	}
+
+	return selected, nil
+}
+
+/*
+Excluded checks whether the given path, or one of its parents, matches an
+exclude pattern.
+*/
+func (r PathRules) Excluded(path string) bool {
+	return matchParents(r.Exclude, path)
+}
+
+func matchParents(patterns []string, path string) bool {
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if matchAny(patterns, p) {
+			return true
+		}
+		if p == "/" || p == "." {
+			return false
+		}
+	}
+}
+
+func matchAny(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isSubPath(parent, path string) bool {
+	return path == parent || strings.HasPrefix(path, strings.TrimSuffix(parent, "/")+"/")
+}
+
+// rootOf returns the most specific of the given managed paths containing
+// path, or an empty string if none does
+func rootOf(roots []string, path string) string {
+	root := ""
+	for _, candidate := range roots {
+		if isSubPath(candidate, path) && len(candidate) > len(root) {
+			root = candidate
+		}
+	}
+	return root
+}
+
+func sameDevice(a, b string) bool {
+	aInfo, err := os.Lstat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Lstat(b)
+	if err != nil {
+		return false
+	}
+	return deviceOf(aInfo) == deviceOf(bInfo)
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, filepath.Clean(item))
+		}
+	}
+	return items
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeDropIn(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "10-test.conf")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseDropIn(t *testing.T) {
+	path := writeDropIn(t, `# vendor paths
+include /opt default=rw group=vendor
+
+include /boot/efi/ strategy=bindmount
+exclude /usr/local
+	append /var/log/audit
+include /srv/*/data default=ro
+`)
+
+	rules := PathRules{}
+	if err := rules.parseDropIn(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"/opt", "/boot/efi", "/srv/*/data"}; !reflect.DeepEqual(rules.Include, want) {
+		t.Errorf("Include = %v, want %v", rules.Include, want)
+	}
+	if want := []string{"/usr/local"}; !reflect.DeepEqual(rules.Exclude, want) {
+		t.Errorf("Exclude = %v, want %v", rules.Exclude, want)
+	}
+	if want := []string{"/var/log/audit"}; !reflect.DeepEqual(rules.Append, want) {
+		t.Errorf("Append = %v, want %v", rules.Append, want)
+	}
+
+	want := []PathPolicy{
+		{Pattern: "/opt", Default: ModeRw, Group: "vendor"},
+		{Pattern: "/boot/efi", Strategy: StrategyBindMount},
+		{Pattern: "/srv/*/data", Default: ModeRo},
+	}
+	if !reflect.DeepEqual(rules.Policies, want) {
+		t.Errorf("Policies = %+v, want %+v", rules.Policies, want)
+	}
+}
+
+func TestParseDropInErrors(t *testing.T) {
+	tests := []struct {
+		line string
+		err  string
+	}{
+		{"include", "expected a directive and a pattern"},
+		{"mount /opt", "unknown directive mount"},
+		{"include /opt/[", "invalid pattern"},
+		{"exclude /opt default=rw", "exclude does not take options"},
+		{"include /opt default", "malformed option default"},
+		{"include /opt default=mixed", "unknown mode"},
+		{"include /opt strategy=overlay", "overlay"},
+		{"include /opt color=red", "unknown option color"},
+	}
+
+	for _, test := range tests {
+		path := writeDropIn(t, "# comment\n"+test.line+"\n")
+
+		rules := PathRules{}
+		err := rules.parseDropIn(path)
+		if err == nil {
+			t.Errorf("%q: no error", test.line)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) || !strings.Contains(err.Error(), ":2:") {
+			t.Errorf("%q: got %q, want %q at line 2", test.line, err, test.err)
+		}
+	}
+}
+
+func TestPolicyOf(t *testing.T) {
+	rules := PathRules{Policies: []PathPolicy{
+		{Pattern: "/opt", Group: "vendor"},
+		{Pattern: "/opt/*", Group: "apps"},
+		{Pattern: "/opt/tools", Group: "tools"},
+		{Pattern: "/srv/*", Default: ModeRw},
+		{Pattern: "/srv/www", Default: ModeRo},
+	}}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/opt", "/opt"},
+		// the most specific path wins, then the last pattern given
+		{"/opt/tools", "/opt/tools"},
+		{"/opt/other", "/opt/*"},
+		{"/opt/other/bin", "/opt/*"},
+		{"/srv/www", "/srv/www"},
+		{"/srv/ftp", "/srv/*"},
+		{"/usr", ""},
+	}
+
+	for _, test := range tests {
+		if got := rules.PolicyOf(test.path).Pattern; got != test.want {
+			t.Errorf("PolicyOf(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"usr/bin", "usr/lib", "opt/app", "srv"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// merged-/usr layout
+	if err := os.Symlink("usr/bin", filepath.Join(dir, "bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := PathRules{
+		Include: []string{
+			filepath.Join(dir, "bin"),
+			filepath.Join(dir, "usr"),
+			filepath.Join(dir, "usr/lib"),
+			filepath.Join(dir, "opt/*"),
+			filepath.Join(dir, "missing"),
+		},
+		Exclude: []string{filepath.Join(dir, "srv")},
+		Append:  []string{filepath.Join(dir, "srv")},
+	}
+
+	want := []string{filepath.Join(dir, "opt/app"), filepath.Join(dir, "usr")}
+	if got := rules.Resolve(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Resolve() = %v, want %v", got, want)
+	}
+}
@@ -3,163 +3,429 @@ package core
 import (
 	"fmt"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"strings"
+	"time"
 )
 
-var managed_paths = []string{
-	"/bin",
-	"/lib",
-	"/lib64",
-	"/sbin",
-	"/usr",
+// modes of the managed paths, see ModeName for the names used in the
+// configuration
+const (
+	ModeRo    = "0"
+	ModeRw    = "1"
+	ModeMixed = "2" // a transition did not complete
+)
+
+/*
+FailurePolicy defines what to do when some files cannot be processed during
+a transition.
+*/
+type FailurePolicy string
+
+const (
+	// FailureKeep leaves the system as it is, in mixed mode
+	FailureKeep FailurePolicy = "keep"
+	// FailureRetry processes the failed files again
+	FailureRetry FailurePolicy = "retry"
+	// FailureRollback restores the files changed by the transition
+	FailureRollback FailurePolicy = "rollback"
+)
+
+/*
+ParseFailurePolicy returns the failure policy with the given name.
+*/
+func ParseFailurePolicy(name string) (FailurePolicy, error) {
+	switch policy := FailurePolicy(name); policy {
+	case FailureKeep, FailureRetry, FailureRollback:
+		return policy, nil
+	case "":
+		return FailureKeep, nil
+	default:
+		return "", fmt.Errorf("unknown failure policy: %s", name)
+	}
+}
+
+/*
+TransitionOptions controls how the system is locked or unlocked.
+*/
+type TransitionOptions struct {
+	// Paths holds the managed paths or groups to process, all if empty
+	Paths     []string
+	Verbose   bool
+	OnFailure FailurePolicy
+	// Retries is the number of attempts made by FailureRetry, 3 if unset
+	Retries int
+	// Progress receives the progress of the transition, if not nil
+	Progress ProgressReporter
+	// Reason is recorded in the runtime state as the cause of the
+	// transition, the command line if empty
+	Reason string
+}
+
+/*
+TransitionError is returned when a transition does not complete, it holds
+the files which could not be processed.
+*/
+type TransitionError struct {
+	Mode       string
+	Failures   []FileError
+	RolledBack bool
+}
+
+func (e *TransitionError) Error() string {
+	action := "unlock"
+	if e.Mode == ModeRo {
+		action = "lock"
+	}
+
+	if e.RolledBack {
+		return fmt.Sprintf("failed to %s %d file(s), changes have been rolled back", action, len(e.Failures))
+	}
+	return fmt.Sprintf("failed to %s %d file(s), the system is in mixed mode", action, len(e.Failures))
+}
+
+func EnterRo(opts TransitionOptions) error {
+	return lockedEnterMode(ModeRo, opts)
 }
 
-func EnterRo(verbose bool) error {
+func EnterRw(opts TransitionOptions) error {
+	return lockedEnterMode(ModeRw, opts)
+}
+
+func lockedEnterMode(mode string, opts TransitionOptions) error {
 	if !RootCheck(false) {
-		return nil
+		return ErrNotRoot
+	}
+
+	unlock, err := LockOperation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return enterMode(mode, opts)
+}
+
+// enterMode moves the selected paths to mode, the caller holds the
+// operation lock
+func enterMode(mode string, opts TransitionOptions) (err error) {
+	rules, err := LoadPathRules()
+	if err != nil {
+		return err
+	}
+	paths, err := rules.Select(opts.Paths)
+	if err != nil {
+		return err
+	}
+
+	event := HookUnlock
+	if mode == ModeRo {
+		event = HookLock
+	}
+	env := HookEnv{
+		"MODE":  ModeName(mode),
+		"PATHS": strings.Join(paths, ":"),
 	}
+	if err := RunPreHooks(event, env); err != nil {
+		return err
+	}
+	defer func() {
+		RunPostHooks(event, env, err)
+	}()
 
-	fmt.Println("Locking system..")
+	state, err := LoadModeState()
+	if err != nil {
+		return err
+	}
 
-	for _, path := range managed_paths {
-		if verbose {
-			fmt.Println("Processing: ", path)
+	// every path is protected by its own backend, paths which cannot be
+	// protected are reported before doing anything
+	strategies := map[string]Strategy{}
+	for _, path := range paths {
+		strategy, info, err := rules.StrategyFor(path)
+		if err != nil {
+			return err
+		}
+		if strategy == StrategyNone && mode == ModeRo {
+			logf("Warning: %s is on %s which does not support file attributes, it will not be protected.\n", path, info.Type)
 		}
-		SetImmutableFlag(path, verbose, 0, false)
+		strategies[path] = strategy
 	}
 
-	fmt.Println("System is now locked.")
-	Set("Almost::CurrentMode", "0")
-	return nil
-}
+	if mode == ModeRo {
+		logln("Locking system..")
+	} else {
+		logln("Unlocking system..")
+	}
 
-func EnterRw(verbose bool) error {
-	if !RootCheck(false) {
+	inv, err := LoadInventory()
+	if err != nil {
+		logln("Ignoring the flag inventory:", err)
+	}
+	if inv == nil {
+		inv = Inventory{}
+	}
+	exceptions, err := LoadExceptions()
+	if err != nil {
+		logln("Ignoring the flag exceptions:", err)
+	}
+	if exceptions == nil {
+		exceptions = Inventory{}
+	}
+
+	ctx := &BackendContext{
+		Rules:   rules,
+		Walk:    rules.WalkOptions(),
+		State:   &state,
+		Verbose: opts.Verbose,
+		Restore: Inventory{},
+	}
+	if mode == ModeRo {
+		// restoring the attributes recorded when the paths were unlocked,
+		// files missing from the inventory were created in the meantime and
+		// get the attributes defined by the path rules
+		for path, attrs := range exceptions {
+			ctx.Restore[path] = attrs
+		}
+		for path, attrs := range inv {
+			ctx.Restore[path] = attrs
+		}
+		ctx.Visited = map[string]bool{}
+	} else {
+		ctx.Record = inv
+	}
+
+	t := newTransition(mode == ModeRo, ctx)
+	for _, path := range paths {
+		t.add(path, strategies[path])
+	}
+
+	if opts.Progress != nil {
+		ctx.progress = newProgressTracker(opts.Progress, countEntries(paths, strategies, ctx.Walk))
+	}
+
+	var summary WalkSummary
+	for _, path := range paths {
+		if opts.Verbose {
+			logln("Processing: ", path)
+		}
+		summary.Add(t.run(path))
+	}
+	// retries and rollbacks are not reported
+	ctx.progress.finish()
+	ctx.progress = nil
+
+	if dryRun {
+		for _, failure := range summary.Failures {
+			logln("Error:", failure.Error())
+		}
+		logf("Dry run: %d would change, %d unchanged, %d skipped, %d failed.\n",
+			summary.Changed, summary.Unchanged, summary.Skipped, summary.Failed)
 		return nil
 	}
 
-	fmt.Println("Unlocking system..")
+	failures := summary.Failures
+	if len(failures) > 0 && opts.OnFailure == FailureRetry {
+		failures = t.retry(failures, opts.Retries)
+	}
+
+	if len(failures) > 0 && opts.OnFailure == FailureRollback {
+		logf("%d file(s) failed, rolling back..\n", len(failures))
+		rollbackFailures := t.rollback()
+		printFailures(rollbackFailures)
+		for path := range failedPaths(paths, rollbackFailures) {
+			state.Paths[path] = ModeMixed
+		}
+		saveModeState(state, mode, paths, opts, len(failures))
+		return &TransitionError{Mode: mode, Failures: failures, RolledBack: len(rollbackFailures) == 0}
+	}
 
-	for _, path := range managed_paths {
-		if verbose {
-			fmt.Println("Processing: ", path)
+	failed := failedPaths(paths, failures)
+	for _, path := range paths {
+		if failed[path] {
+			state.Paths[path] = ModeMixed
+			continue
 		}
+		state.Paths[path] = mode
 
-		SetImmutableFlag(path, verbose, 1, false)
+		// once a path is locked its inventory is not needed anymore, only
+		// the files with different attributes than the rules are kept,
+		// unless they are gone. The walk of the other backends does not
+		// visit the files, their exceptions are kept as they are
+		if t.lock {
+			prune := strategies[path] == StrategyChattr
+			exceptions.RemoveUnder(path)
+			for file, attrs := range ctx.Restore.Exceptions(path, rules) {
+				if !prune || ctx.Visited[file] {
+					exceptions[file] = attrs
+				}
+			}
+			inv.RemoveUnder(path)
+		}
+	}
+
+	if err := inv.Save(); err != nil {
+		logln("Error saving the flag inventory:", err)
+	}
+	if t.lock {
+		if err := exceptions.SaveExceptions(); err != nil {
+			logln("Error saving the flag exceptions:", err)
+		}
 	}
 
-	fmt.Println("System is now unlocked.")
-	Set("Almost::CurrentMode", "1")
+	// locking every path of an open read-write window closes it
+	if t.lock && state.Window != nil {
+		windowPaths, err := rules.Select(state.Window.Paths)
+		if err != nil || state.Current(windowPaths) == ModeRo {
+			stopRelockTimer()
+			state.Window = nil
+		}
+	}
+	saveModeState(state, mode, paths, opts, len(failures))
+
+	if len(failures) > 0 {
+		printFailures(failures)
+		return &TransitionError{Mode: mode, Failures: failures}
+	}
+
+	// the manifest describes the system as a whole, so it is only built once
+	// every managed path is locked
+	if t.lock && state.Current(rules.Resolve()) == ModeRo {
+		if GetBool("Almost::IntegrityManifest") {
+			logln("Building the integrity manifest..")
+			if err := WriteManifest(rules); err != nil {
+				logln("Error building the integrity manifest:", err)
+			}
+		}
+	}
+
+	target := "System"
+	if len(opts.Paths) > 0 {
+		target = strings.Join(paths, ", ")
+	}
+	if t.lock {
+		logf("%s is now locked (%d changed, %d skipped).\n", target, summary.Changed, summary.Skipped)
+	} else {
+		logf("%s is now unlocked (%d changed, %d skipped).\n", target, summary.Changed, summary.Skipped)
+	}
 	return nil
 }
 
-func EnterDefault(verbose bool, on_persistent bool) error {
+// failedPaths returns the managed paths containing at least one failure
+func failedPaths(paths []string, failures []FileError) map[string]bool {
+	failed := map[string]bool{}
+	for _, failure := range failures {
+		for _, path := range paths {
+			if isSubPath(path, failure.Path) {
+				failed[path] = true
+			}
+		}
+	}
+	return failed
+}
+
+// saveModeState stores the mode of every managed path together with the
+// transition which led to it
+func saveModeState(state ModeState, mode string, paths []string, opts TransitionOptions, failed int) {
+	reason := opts.Reason
+	if reason == "" {
+		reason = strings.Join(os.Args, " ")
+	}
+	state.LastTransition = &Transition{
+		Time:   time.Now(),
+		Mode:   ModeName(mode),
+		Paths:  paths,
+		Reason: reason,
+		Failed: failed,
+	}
+
+	if err := state.Save(); err != nil {
+		logln("Error saving the current mode:", err)
+	}
+}
+
+func printFailures(failures []FileError) {
+	const maxShown = 10
+
+	for i, failure := range failures {
+		if i == maxShown {
+			logf("..and %d more\n", len(failures)-maxShown)
+			break
+		}
+		logln("Error:", failure.Error())
+	}
+}
+
+func EnterDefault(opts TransitionOptions, on_persistent bool) error {
 	if !RootCheck(false) {
-		return nil
+		return ErrNotRoot
 	}
 
-	confDefault, _ := Get("Almost::DefaultMode")
-	confPersist, _ := Get("Almost::PersistModeStatus")
+	confDefault := GetMode("Almost::DefaultMode")
+	confPersist := GetBool("Almost::PersistModeStatus")
 
 	if on_persistent {
 		// this is being called by the systemd unit on shutdown
 		// here we check for offline updates, then set the rw mode
 		// to allow PackageKit install them on next boot
-		if PackageKitUpdatePrepared() || PackageKitUpgradePrepared() {
-			fmt.Println("Offline updates found! Entering rw mode..")
-			return EnterRw(verbose)
+		if offlineUpdatesPrepared() {
+			logln("Offline updates found! Entering rw mode..")
+			opts.Reason = "offline updates prepared"
+			return lockedEnterMode(ModeRw, opts)
 		}
 		// with no updates found, we skip switching mode if the user
 		// disabled the persistent mode
-		if confPersist == "1" {
-			fmt.Println("Persistent mode is disabled, nothing to do.")
+		if !confPersist {
+			logln("Persistent mode is disabled, nothing to do.")
 			return nil
 		}
 	}
 
-	if confDefault == "0" {
-		EnterRo(verbose)
-	} else {
-		EnterRw(verbose)
+	unlock, err := LockOperation()
+	if err != nil {
+		return err
 	}
-	return nil
-}
+	defer unlock()
 
-func SetImmutableFlag(path string, verbose bool, state int, ifDiff bool) error {
-	if verbose {
-		fmt.Println("Processing: ", path)
+	// the leases of dead processes are dropped, the paths they unlocked
+	// enter their default mode with the others
+	if _, _, err := reapLeases(); err != nil {
+		return err
 	}
 
-	if ifDiff {
-		// Here we check if the file already respects the Almost::CurrentMode
-		// if it does, we skip it. This is useful to predict and restore the
-		// prior state when taking temporary ownership.
-		current := GetImmutableFlag(path)
-		currentConfig, _ := Get("Almost::CurrentMode")
-		if fmt.Sprint(current) == currentConfig {
-			return nil
-		}
+	// every managed path enters its own default mode, falling back to
+	// Almost::DefaultMode
+	if opts.Reason == "" {
+		opts.Reason = "default mode"
+	}
+	rules, err := LoadPathRules()
+	if err != nil {
+		return err
 	}
 
-	files, _ := filepath.Glob(filepath.Join(path, "*"))
-
-	for _, file := range files {
-		fi, err := os.OpenFile(file, os.O_RDONLY, 0755)
-		useLegacy := false
-
-		if err != nil {
-			if verbose {
-				fmt.Printf("Error opening %s: %v, try setting using the legacy chattr tool\n", file, err)
-				useLegacy = true
-			}
-
-			fi, err = os.Open(file)
-			if err != nil {
-				if verbose {
-					fmt.Printf("Skipping %s: %s\n", file, err.Error())
-					continue
-				}
-			}
+	roPaths, rwPaths := []string{}, []string{}
+	for _, path := range rules.Resolve() {
+		mode := rules.PolicyOf(path).Default
+		if mode == "" {
+			mode = confDefault
 		}
-
-		if state == 0 {
-			if useLegacy {
-				err := LegacySetAttr(file, "i")
-				if err != nil && verbose {
-					fmt.Printf("(legacy) Error setting immutable flag on %s: %s\n", file, err.Error())
-				}
-			} else {
-				err := SetAttr(fi, FS_IMMUTABLE_FL)
-				if err != nil && verbose {
-					fmt.Println("Error while removing immutable flag: ", err)
-				}
-			}
+		if mode == ModeRo {
+			roPaths = append(roPaths, path)
 		} else {
-			if useLegacy {
-				err := LegacyUnsetAttr(file, "i")
-				if err != nil && verbose {
-					fmt.Printf("(legacy) Error removing immutable flag on %s: %s\n", file, err.Error())
-				}
-			} else {
-				err := UnsetAttr(fi, FS_IMMUTABLE_FL)
-				if err != nil && verbose {
-					fmt.Println("Error while setting immutable flag: ", err)
-				}
-			}
+			rwPaths = append(rwPaths, path)
 		}
 	}
 
-	return nil
-}
-
-func GetImmutableFlag(path string) int {
-	out, err := exec.Command("lsattr", path).Output()
-	if err != nil {
-		return 0
+	if len(roPaths) > 0 {
+		roOpts := opts
+		roOpts.Paths = roPaths
+		if err := enterMode(ModeRo, roOpts); err != nil {
+			return err
+		}
 	}
-	if string(out[4]) == "i" {
-		return 1
+	if len(rwPaths) > 0 {
+		rwOpts := opts
+		rwOpts.Paths = rwPaths
+		return enterMode(ModeRw, rwOpts)
 	}
-	return 0
+	return nil
 }
@@ -0,0 +1,118 @@
+package core
+
+import (
+	"io/fs"
+	"time"
+)
+
+/*
+Progress describes how far a transition has gone.
+*/
+type Progress struct {
+	Done  int
+	Total int
+	// Path is the file being processed
+	Path    string
+	Elapsed time.Duration
+	// ETA is the estimated time left, 0 until it can be estimated
+	ETA time.Duration
+}
+
+/*
+ProgressReporter receives the progress of lock and unlock operations, set
+it in TransitionOptions to enable the counting pass made before the
+transition starts.
+*/
+type ProgressReporter interface {
+	// Start is called once the entries to process have been counted
+	Start(total int)
+	// Update is called while the entries are processed, at most every
+	// progressInterval
+	Update(p Progress)
+	// Finish is called once every entry has been processed
+	Finish(p Progress)
+}
+
+const progressInterval = 100 * time.Millisecond
+
+// progressTracker counts the processed entries and forwards the progress
+// to the reporter, a nil tracker does nothing
+type progressTracker struct {
+	reporter ProgressReporter
+	total    int
+	done     int
+	start    time.Time
+	last     time.Time
+}
+
+func newProgressTracker(reporter ProgressReporter, total int) *progressTracker {
+	reporter.Start(total)
+
+	return &progressTracker{
+		reporter: reporter,
+		total:    total,
+		start:    time.Now(),
+	}
+}
+
+func (t *progressTracker) step(path string) {
+	if t == nil {
+		return
+	}
+
+	// entries processed again by retries are not counted twice
+	if t.done < t.total {
+		t.done++
+	}
+
+	now := time.Now()
+	if now.Sub(t.last) < progressInterval {
+		return
+	}
+	t.last = now
+	t.reporter.Update(t.progress(path))
+}
+
+func (t *progressTracker) finish() {
+	if t == nil {
+		return
+	}
+
+	t.done = t.total
+	t.reporter.Finish(t.progress(""))
+}
+
+func (t *progressTracker) progress(path string) Progress {
+	p := Progress{
+		Done:    t.done,
+		Total:   t.total,
+		Path:    path,
+		Elapsed: time.Since(t.start),
+	}
+	if p.Done > 0 && p.Total > p.Done {
+		p.ETA = time.Duration(int64(p.Elapsed) / int64(p.Done) * int64(p.Total-p.Done))
+	}
+
+	return p
+}
+
+// countEntries returns the number of entries a transition of the given
+// managed paths processes, the paths not protected by the chattr backend
+// count as a single entry
+func countEntries(paths []string, strategies map[string]Strategy, opts WalkOptions) int {
+	total := 0
+
+	for _, path := range paths {
+		if strategies[path] != StrategyChattr {
+			total++
+			continue
+		}
+
+		summary, _ := Walk(path, opts, func(string, fs.DirEntry) (bool, error) {
+			return false, nil
+		})
+		total += summary.Unchanged
+	}
+
+	return total
+}
@@ -0,0 +1,300 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ConfigType is the type of the value of a configuration key.
+*/
+type ConfigType string
+
+const (
+	TypeMode ConfigType = "mode" // ro or rw
+	TypeBool ConfigType = "bool" // on or off
+	TypeInt  ConfigType = "int"
+	TypeEnum ConfigType = "enum" // one of the allowed values
+	TypeList ConfigType = "list" // comma separated absolute glob patterns
+)
+
+/*
+ConfigKey declares a configuration key, its type and the values it accepts.
+*/
+type ConfigKey struct {
+	Name        string
+	Type        ConfigType
+	Default     string
+	Description string
+	// Values holds the allowed values of enum and mode keys
+	Values []string
+	// Legacy maps the values used by older versions to the current ones
+	Legacy map[string]string
+	// Min is the minimum value of int keys
+	Min int
+}
+
+var (
+	legacyMode = map[string]string{"0": "ro", "1": "rw", "2": "mixed"}
+	legacyBool = map[string]string{"0": "off", "1": "on"}
+)
+
+/*
+Schema declares every configuration key.
+*/
+var Schema = []ConfigKey{
+	{
+		Name:        "Almost::DefaultMode",
+		Type:        TypeMode,
+		Default:     "ro",
+		Description: "mode entered at boot and by almost enter default",
+		Values:      []string{"ro", "rw"},
+		Legacy:      legacyMode,
+	},
+	{
+		Name:        "Almost::PersistModeStatus",
+		Type:        TypeBool,
+		Default:     "on",
+		Description: "restore the default mode at shutdown",
+		// this key used to be inverted, 0 meant on
+		Legacy: map[string]string{"0": "on", "1": "off"},
+	},
+	{
+		Name:        "Almost::MaxDepth",
+		Type:        TypeInt,
+		Default:     "-1",
+		Description: "maximum depth processed below the managed paths, -1 for no limit",
+		Min:         -1,
+	},
+	{
+		Name:        "Almost::IncludePaths",
+		Type:        TypeList,
+		Description: "additional managed paths",
+	},
+	{
+		Name:        "Almost::ExcludePaths",
+		Type:        TypeList,
+		Description: "paths left out of the managed paths",
+	},
+	{
+		Name:        "Almost::AppendPaths",
+		Type:        TypeList,
+		Description: "managed paths set append-only instead of immutable",
+	},
+	{
+		Name:        "Almost::Backend",
+		Type:        TypeEnum,
+		Default:     "chattr",
+		Description: "how the managed paths are protected",
+		Values:      []string{"chattr", "bindmount"},
+	},
+	{
+		Name:        "Almost::UnsupportedFs",
+		Type:        TypeEnum,
+		Default:     "warn",
+		Description: "what to do with paths on file systems without file attributes",
+		Values:      []string{"warn", "bindmount", "refuse"},
+	},
+	{
+		Name:        "Almost::IntegrityManifest",
+		Type:        TypeBool,
+		Default:     "off",
+		Description: "build a signed manifest of the managed paths when locking",
+		Legacy:      legacyBool,
+	},
+	{
+		Name:        "Almost::SessionAudit",
+		Type:        TypeBool,
+		Default:     "on",
+		Description: "record the changes made during almost run and almost shell",
+		Legacy:      legacyBool,
+	},
+}
+
+/*
+LookupKey returns the declaration of a configuration key, the Almost::
+prefix is optional and the case does not matter.
+*/
+func LookupKey(name string) (ConfigKey, error) {
+	full := name
+	if !strings.Contains(name, "::") {
+		full = Section + "::" + name
+	}
+
+	for _, key := range Schema {
+		if strings.EqualFold(key.Name, full) {
+			return key, nil
+		}
+	}
+
+	if suggestion := closestKey(full); suggestion != "" {
+		return ConfigKey{}, fmt.Errorf("unknown configuration key %s, did you mean %s?", name, suggestion)
+	}
+	return ConfigKey{}, fmt.Errorf("unknown configuration key %s, see almost config describe", name)
+}
+
+/*
+Normalize validates a value and returns it in its canonical form, legacy
+values are converted.
+*/
+func (k ConfigKey) Normalize(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if legacy, ok := k.Legacy[value]; ok {
+		value = legacy
+	}
+
+	switch k.Type {
+	case TypeMode, TypeEnum:
+		value = strings.ToLower(value)
+		for _, allowed := range k.Values {
+			if value == allowed {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("invalid value %q for %s, expected one of: %s", value, k.Name, strings.Join(k.Values, ", "))
+	case TypeBool:
+		value = strings.ToLower(value)
+		if value == "on" || value == "off" {
+			return value, nil
+		}
+		return "", fmt.Errorf("invalid value %q for %s, expected on or off", value, k.Name)
+	case TypeInt:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < k.Min {
+			return "", fmt.Errorf("invalid value %q for %s, expected an integer not lower than %d", value, k.Name, k.Min)
+		}
+		return strconv.Itoa(n), nil
+	case TypeList:
+		items := splitList(value)
+		for _, item := range items {
+			if !filepath.IsAbs(item) {
+				return "", fmt.Errorf("invalid path %q for %s, expected an absolute path", item, k.Name)
+			}
+			if _, err := filepath.Match(item, ""); err != nil {
+				return "", fmt.Errorf("invalid pattern %q for %s: %s", item, k.Name, err)
+			}
+		}
+		return strings.Join(items, ","), nil
+	}
+
+	return value, nil
+}
+
+/*
+Allowed returns a readable description of the values the key accepts.
+*/
+func (k ConfigKey) Allowed() string {
+	switch k.Type {
+	case TypeMode, TypeEnum:
+		return strings.Join(k.Values, ", ")
+	case TypeBool:
+		return "on, off"
+	case TypeInt:
+		return fmt.Sprintf("integer >= %d", k.Min)
+	case TypeList:
+		return "comma separated absolute glob patterns"
+	}
+	return ""
+}
+
+/*
+GetValue returns the canonical value of a key, the default if the stored
+one is not valid.
+*/
+func GetValue(name string) string {
+	key, err := LookupKey(name)
+	if err != nil {
+		return ""
+	}
+
+	raw, err := Get(key.Name)
+	if err != nil {
+		return key.Default
+	}
+	value, err := key.Normalize(raw)
+	if err != nil {
+		return key.Default
+	}
+	return value
+}
+
+/*
+GetMode returns the mode stored in a mode key, as one of ModeRo, ModeRw and
+ModeMixed.
+*/
+func GetMode(name string) string {
+	mode, err := ParseMode(GetValue(name))
+	if err != nil {
+		return ModeMixed
+	}
+	return mode
+}
+
+/*
+GetBool returns whether a bool key is on.
+*/
+func GetBool(name string) bool {
+	return GetValue(name) == "on"
+}
+
+/*
+GetInt returns the value of an int key.
+*/
+func GetInt(name string) int {
+	n, _ := strconv.Atoi(GetValue(name))
+	return n
+}
+
+// closestKey returns the key name closest to the given one, if close
+// enough to be a typo
+func closestKey(name string) string {
+	best, bestDistance := "", 4
+	for _, key := range Schema {
+		if d := editDistance(strings.ToLower(name), strings.ToLower(key.Name)); d < bestDistance {
+			best, bestDistance = key.Name, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+func schemaDefaults() map[string]interface{} {
+	defaults := map[string]interface{}{}
+	for _, key := range Schema {
+		defaults[key.Name] = key.Default
+	}
+	return defaults
+}
@@ -0,0 +1,84 @@
+package core
+
+import "testing"
+
+func TestLookupKey(t *testing.T) {
+	for _, name := range []string{"Almost::DefaultMode", "almost::defaultmode", "DefaultMode", "defaultmode"} {
+		key, err := LookupKey(name)
+		if err != nil {
+			t.Errorf("LookupKey(%q): %s", name, err)
+			continue
+		}
+		if key.Name != "Almost::DefaultMode" {
+			t.Errorf("LookupKey(%q) = %s, want Almost::DefaultMode", name, key.Name)
+		}
+	}
+
+	for _, name := range []string{"Almost::Nope", "Other::DefaultMode", "CurrentMode"} {
+		if _, err := LookupKey(name); err == nil {
+			t.Errorf("LookupKey(%q) did not fail", name)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		want  string
+		fails bool
+	}{
+		{key: "DefaultMode", value: "ro", want: "ro"},
+		{key: "DefaultMode", value: " RW ", want: "rw"},
+		{key: "DefaultMode", value: "0", want: "ro"},
+		{key: "DefaultMode", value: "1", want: "rw"},
+		// mixed is a state, not a mode which can be entered
+		{key: "DefaultMode", value: "2", fails: true},
+		{key: "DefaultMode", value: "readonly", fails: true},
+		// PersistModeStatus used to be inverted
+		{key: "PersistModeStatus", value: "0", want: "on"},
+		{key: "PersistModeStatus", value: "1", want: "off"},
+		{key: "PersistModeStatus", value: "Off", want: "off"},
+		{key: "PersistModeStatus", value: "yes", fails: true},
+		{key: "SessionAudit", value: "0", want: "off"},
+		{key: "SessionAudit", value: "1", want: "on"},
+		{key: "MaxDepth", value: "-1", want: "-1"},
+		{key: "MaxDepth", value: "007", want: "7"},
+		{key: "MaxDepth", value: "-2", fails: true},
+		{key: "MaxDepth", value: "deep", fails: true},
+		{key: "Backend", value: "BindMount", want: "bindmount"},
+		{key: "Backend", value: "overlay", fails: true},
+		{key: "IncludePaths", value: "", want: ""},
+		{key: "IncludePaths", value: " /opt , /srv/* ", want: "/opt,/srv/*"},
+		{key: "IncludePaths", value: "opt", fails: true},
+		{key: "IncludePaths", value: "/opt/[", fails: true},
+	}
+
+	for _, test := range tests {
+		key, err := LookupKey(test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := key.Normalize(test.value)
+		switch {
+		case test.fails && err == nil:
+			t.Errorf("%s: Normalize(%q) = %q, want an error", test.key, test.value, got)
+		case !test.fails && err != nil:
+			t.Errorf("%s: Normalize(%q): %s", test.key, test.value, err)
+		case !test.fails && got != test.want:
+			t.Errorf("%s: Normalize(%q) = %q, want %q", test.key, test.value, got, test.want)
+		}
+	}
+}
+
+func TestSchemaDefaults(t *testing.T) {
+	for _, key := range Schema {
+		if key.Default == "" {
+			continue
+		}
+		if got, err := key.Normalize(key.Default); err != nil || got != key.Default {
+			t.Errorf("%s: the default %q is not canonical", key.Name, key.Default)
+		}
+	}
+}
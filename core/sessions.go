@@ -0,0 +1,459 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var sessionsDir = "/var/log/almost/sessions"
+
+// changes reported by the session auditing, moves are reported as a
+// deletion of the old path and a creation of the new one
+const (
+	ChangeCreated  = "created"
+	ChangeModified = "modified"
+	ChangeDeleted  = "deleted"
+	ChangeMetadata = "metadata"
+)
+
+const sessionEventMask = unix.FAN_CREATE | unix.FAN_DELETE | unix.FAN_MOVED_FROM |
+	unix.FAN_MOVED_TO | unix.FAN_MODIFY | unix.FAN_ATTRIB | unix.FAN_ONDIR
+
+/*
+SessionEvent describes a change made to a file in the managed paths during
+a read-write session, repeated changes of the same kind by the same process
+are reported once.
+*/
+type SessionEvent struct {
+	Time   time.Time `json:"time"`
+	Path   string    `json:"path"`
+	Change string    `json:"change"`
+	Pid    int       `json:"pid"`
+	Comm   string    `json:"comm"`
+	Count  int       `json:"count"`
+}
+
+/*
+SessionReport holds the changes recorded during a read-write session.
+*/
+type SessionReport struct {
+	ID      string         `json:"id"`
+	Command []string       `json:"command"`
+	User    string         `json:"user"`
+	Start   time.Time      `json:"start"`
+	End     time.Time      `json:"end"`
+	Paths   []string       `json:"paths"`
+	Events  []SessionEvent `json:"events"`
+	// Overflow is set when the kernel dropped some events, the report is
+	// not complete then
+	Overflow bool     `json:"overflow"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+/*
+Session records the changes made to the managed paths using fanotify, from
+StartSession until Stop.
+*/
+type Session struct {
+	report   SessionReport
+	fd       int
+	rules    PathRules
+	mountFds map[unix.Fsid]int
+	dirs     map[string]string
+	seen     map[string]int
+	stop     chan struct{}
+	// done is closed once the reader goroutine, which owns the report
+	// until then, returns
+	done chan struct{}
+}
+
+/*
+StartSession starts recording the changes made to the managed paths by the
+given command. It fails if the kernel does not support fanotify with
+directory file handles (Linux 5.9 or later).
+*/
+func StartSession(command []string) (*Session, error) {
+	if !GetBool("Almost::SessionAudit") {
+		return nil, nil
+	}
+
+	rules, err := LoadPathRules()
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK|unix.FAN_REPORT_DFID_NAME, unix.O_RDONLY)
+	if err != nil {
+		return nil, fmt.Errorf("fanotify is not available: %s", err)
+	}
+
+	s := &Session{
+		report: SessionReport{
+			ID:      time.Now().Format("20060102-150405") + "-" + strconv.Itoa(os.Getpid()),
+			Command: command,
+			User:    sessionUser(),
+			Start:   time.Now(),
+			Paths:   rules.Resolve(),
+			Events:  []SessionEvent{},
+		},
+		fd:       fd,
+		rules:    rules,
+		mountFds: map[unix.Fsid]int{},
+		dirs:     map[string]string{},
+		seen:     map[string]int{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	// the whole file system of every managed path is marked, events outside
+	// the managed paths are filtered out
+	for _, path := range s.report.Paths {
+		var st unix.Statfs_t
+		if err := unix.Statfs(path, &st); err != nil {
+			s.warn("%s: %s", path, err)
+			continue
+		}
+		if _, ok := s.mountFds[st.Fsid]; ok {
+			continue
+		}
+
+		if err := unix.FanotifyMark(fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, sessionEventMask, unix.AT_FDCWD, path); err != nil {
+			s.warn("%s will not be audited: %s", path, err)
+			continue
+		}
+
+		mountFd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			s.warn("%s: %s", path, err)
+			continue
+		}
+		s.mountFds[st.Fsid] = mountFd
+	}
+
+	if len(s.mountFds) == 0 {
+		s.close()
+		return nil, fmt.Errorf("none of the managed paths can be audited")
+	}
+
+	go s.read()
+
+	return s, nil
+}
+
+/*
+Stop ends the session and saves its report in /var/log/almost/sessions.
+*/
+func (s *Session) Stop() (SessionReport, error) {
+	close(s.stop)
+	<-s.done
+	s.close()
+
+	s.report.End = time.Now()
+
+	if err := os.MkdirAll(sessionsDir, 0750); err != nil {
+		return s.report, err
+	}
+
+	data, err := json.MarshalIndent(s.report, "", "  ")
+	if err != nil {
+		return s.report, err
+	}
+
+	return s.report, os.WriteFile(filepath.Join(sessionsDir, s.report.ID+".json"), data, 0640)
+}
+
+/*
+ListSessions returns the reports of the recorded sessions, oldest first.
+*/
+func ListSessions() ([]SessionReport, error) {
+	files, err := filepath.Glob(filepath.Join(sessionsDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []SessionReport{}
+	for _, file := range files {
+		report, err := LoadSession(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Start.Before(reports[j].Start)
+	})
+
+	return reports, nil
+}
+
+/*
+LoadSession returns the report of the session with the given ID.
+*/
+func LoadSession(id string) (SessionReport, error) {
+	var report SessionReport
+
+	if id == "" || strings.ContainsRune(id, '/') {
+		return report, fmt.Errorf("invalid session ID: %s", id)
+	}
+
+	data, err := os.ReadFile(filepath.Join(sessionsDir, id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return report, fmt.Errorf("session %s not found", id)
+		}
+		return report, err
+	}
+
+	err = json.Unmarshal(data, &report)
+	return report, err
+}
+
+func (s *Session) warn(format string, args ...interface{}) {
+	s.report.Warnings = append(s.report.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (s *Session) close() {
+	for _, mountFd := range s.mountFds {
+		unix.Close(mountFd)
+	}
+	unix.Close(s.fd)
+}
+
+// read processes the events until the session is stopped, then drains the
+// events left in the queue
+func (s *Session) read() {
+	defer close(s.done)
+
+	buf := make([]byte, 64*1024)
+	fds := []unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLIN}}
+	stopping := false
+
+	for {
+		select {
+		case <-s.stop:
+			stopping = true
+		default:
+		}
+
+		if !stopping {
+			if _, err := unix.Poll(fds, 200); err != nil && !errors.Is(err, unix.EINTR) {
+				s.warn("stopped reading the events: %s", err)
+				return
+			}
+		}
+
+		n, err := unix.Read(s.fd, buf)
+		switch {
+		case errors.Is(err, unix.EAGAIN), errors.Is(err, unix.EINTR):
+			if stopping {
+				return
+			}
+			continue
+		case err != nil:
+			s.warn("stopped reading the events: %s", err)
+			return
+		}
+
+		s.parse(buf[:n])
+	}
+}
+
+func (s *Session) parse(buf []byte) {
+	self := os.Getpid()
+
+	for len(buf) >= int(unsafe.Sizeof(unix.FanotifyEventMetadata{})) {
+		meta := *(*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[0]))
+		if meta.Event_len < uint32(meta.Metadata_len) || int(meta.Event_len) > len(buf) {
+			return
+		}
+		event := buf[:meta.Event_len]
+		buf = buf[meta.Event_len:]
+
+		if meta.Vers != unix.FANOTIFY_METADATA_VERSION {
+			continue
+		}
+		if meta.Mask&unix.FAN_Q_OVERFLOW != 0 {
+			s.report.Overflow = true
+			continue
+		}
+		if int(meta.Pid) == self {
+			continue
+		}
+
+		path, ok := s.eventPath(event[meta.Metadata_len:])
+		if !ok || rootOf(s.report.Paths, path) == "" || s.rules.Excluded(path) {
+			continue
+		}
+
+		for _, change := range sessionChanges(meta.Mask) {
+			s.record(path, change, int(meta.Pid))
+		}
+	}
+}
+
+func sessionChanges(mask uint64) []string {
+	changes := []string{}
+
+	if mask&(unix.FAN_CREATE|unix.FAN_MOVED_TO) != 0 {
+		changes = append(changes, ChangeCreated)
+	}
+	if mask&unix.FAN_MODIFY != 0 {
+		changes = append(changes, ChangeModified)
+	}
+	if mask&unix.FAN_ATTRIB != 0 {
+		changes = append(changes, ChangeMetadata)
+	}
+	if mask&(unix.FAN_DELETE|unix.FAN_MOVED_FROM) != 0 {
+		changes = append(changes, ChangeDeleted)
+	}
+
+	return changes
+}
+
+// eventPath resolves the directory file handle and name reported with an
+// event into a path
+func (s *Session) eventPath(info []byte) (string, bool) {
+	fid, ok := parseFidRecord(info)
+	if !ok {
+		return "", false
+	}
+
+	dir, ok := s.resolveDir(fid.fsid, fid.handleType, fid.handle)
+	if !ok {
+		return "", false
+	}
+	if fid.name == "" || fid.name == "." {
+		return dir, true
+	}
+	return filepath.Join(dir, fid.name), true
+}
+
+// fidRecord is the directory file handle reported with an event, and the
+// name of the entry concerned if any
+type fidRecord struct {
+	fsid       unix.Fsid
+	handleType int32
+	handle     []byte
+	name       string
+}
+
+// parseFidRecord returns the first directory file handle found in the
+// information records following the metadata of an event
+func parseFidRecord(info []byte) (fidRecord, bool) {
+	// struct fanotify_event_info_fid: header (type, pad, len), fsid, then
+	// struct file_handle (handle_bytes, handle_type, f_handle) followed by
+	// the name, all in native byte order
+	for len(info) >= 4 {
+		infoType := info[0]
+		infoLen := int(*(*uint16)(unsafe.Pointer(&info[2])))
+		if infoLen < 20 || infoLen > len(info) {
+			return fidRecord{}, false
+		}
+		record := info[:infoLen]
+		info = info[infoLen:]
+
+		if infoType != unix.FAN_EVENT_INFO_TYPE_DFID_NAME && infoType != unix.FAN_EVENT_INFO_TYPE_DFID {
+			continue
+		}
+
+		fid := fidRecord{
+			fsid:       *(*unix.Fsid)(unsafe.Pointer(&record[4])),
+			handleType: *(*int32)(unsafe.Pointer(&record[16])),
+		}
+		handleBytes := int(*(*uint32)(unsafe.Pointer(&record[12])))
+		if 20+handleBytes > len(record) {
+			return fidRecord{}, false
+		}
+		fid.handle = record[20 : 20+handleBytes]
+
+		if infoType == unix.FAN_EVENT_INFO_TYPE_DFID_NAME {
+			fid.name = string(record[20+handleBytes:])
+			if i := strings.IndexByte(fid.name, 0); i >= 0 {
+				fid.name = fid.name[:i]
+			}
+		}
+		return fid, true
+	}
+
+	return fidRecord{}, false
+}
+
+// resolveDir returns the path of the directory with the given handle,
+// directories are cached since they are seldom renamed during a session
+func (s *Session) resolveDir(fsid unix.Fsid, handleType int32, handle []byte) (string, bool) {
+	key := fmt.Sprintf("%v:%d:%x", fsid.Val, handleType, handle)
+	if dir, ok := s.dirs[key]; ok {
+		return dir, true
+	}
+
+	mountFd, ok := s.mountFds[fsid]
+	if !ok {
+		return "", false
+	}
+
+	fd, err := unix.OpenByHandleAt(mountFd, unix.NewFileHandle(handleType, append([]byte{}, handle...)), unix.O_PATH)
+	if err != nil {
+		return "", false
+	}
+	defer unix.Close(fd)
+
+	dir, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+	if err != nil {
+		return "", false
+	}
+
+	s.dirs[key] = dir
+	return dir, true
+}
+
+func (s *Session) record(path string, change string, pid int) {
+	key := fmt.Sprintf("%d:%s:%s", pid, change, path)
+	if i, ok := s.seen[key]; ok {
+		s.report.Events[i].Count++
+		return
+	}
+
+	s.seen[key] = len(s.report.Events)
+	s.report.Events = append(s.report.Events, SessionEvent{
+		Time:   time.Now(),
+		Path:   path,
+		Change: change,
+		Pid:    pid,
+		Comm:   processName(pid),
+		Count:  1,
+	})
+}
+
+func processName(pid int) string {
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return "?"
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// sessionUser returns the user who started the session, the one logged in
+// rather than root when possible
+func sessionUser() string {
+	if user := CurrentUser(); user != "" {
+		return user
+	}
+	if user := os.Getenv("SUDO_USER"); user != "" {
+		return user
+	}
+	if user := os.Getenv("USER"); user != "" {
+		return user
+	}
+	return strconv.Itoa(os.Getuid())
+}
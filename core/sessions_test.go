@@ -0,0 +1,104 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fidInfo builds a struct fanotify_event_info_fid record, padded as the
+// kernel does
+func fidInfo(infoType byte, fsid unix.Fsid, handleType int32, handle []byte, name string) []byte {
+	record := make([]byte, 20, 64)
+	record[0] = infoType
+	*(*unix.Fsid)(unsafe.Pointer(&record[4])) = fsid
+	*(*uint32)(unsafe.Pointer(&record[12])) = uint32(len(handle))
+	*(*int32)(unsafe.Pointer(&record[16])) = handleType
+	record = append(record, handle...)
+	if infoType == unix.FAN_EVENT_INFO_TYPE_DFID_NAME {
+		record = append(record, name...)
+		record = append(record, 0)
+	}
+	for len(record)%4 != 0 {
+		record = append(record, 0)
+	}
+
+	*(*uint16)(unsafe.Pointer(&record[2])) = uint16(len(record))
+	return record
+}
+
+func TestParseFidRecord(t *testing.T) {
+	fsid := unix.Fsid{Val: [2]int32{0x1234, -5}}
+	handle := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	tests := []struct {
+		name string
+		info []byte
+		want fidRecord
+	}{
+		{
+			name: "dfid name",
+			info: fidInfo(unix.FAN_EVENT_INFO_TYPE_DFID_NAME, fsid, 1, handle, "passwd"),
+			want: fidRecord{fsid: fsid, handleType: 1, handle: handle, name: "passwd"},
+		},
+		{
+			name: "dfid",
+			info: fidInfo(unix.FAN_EVENT_INFO_TYPE_DFID, fsid, 2, handle, ""),
+			want: fidRecord{fsid: fsid, handleType: 2, handle: handle},
+		},
+		{
+			name: "name with spaces",
+			info: fidInfo(unix.FAN_EVENT_INFO_TYPE_DFID_NAME, fsid, 1, handle[:5], "a b.conf"),
+			want: fidRecord{fsid: fsid, handleType: 1, handle: handle[:5], name: "a b.conf"},
+		},
+		{
+			name: "after a fid record",
+			info: append(fidInfo(unix.FAN_EVENT_INFO_TYPE_FID, fsid, 3, handle[:4], ""),
+				fidInfo(unix.FAN_EVENT_INFO_TYPE_DFID_NAME, fsid, 1, handle, "shadow")...),
+			want: fidRecord{fsid: fsid, handleType: 1, handle: handle, name: "shadow"},
+		},
+	}
+
+	for _, test := range tests {
+		got, ok := parseFidRecord(test.info)
+		if !ok {
+			t.Errorf("%s: not parsed", test.name)
+			continue
+		}
+		if got.fsid != test.want.fsid || got.handleType != test.want.handleType ||
+			!bytes.Equal(got.handle, test.want.handle) || got.name != test.want.name {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseFidRecordMalformed(t *testing.T) {
+	fsid := unix.Fsid{Val: [2]int32{1, 2}}
+	valid := fidInfo(unix.FAN_EVENT_INFO_TYPE_DFID_NAME, fsid, 1, []byte{1, 2, 3, 4}, "file")
+
+	truncated := append([]byte{}, valid...)
+	truncated = truncated[:len(truncated)-4]
+
+	shortLen := append([]byte{}, valid...)
+	*(*uint16)(unsafe.Pointer(&shortLen[2])) = 12
+
+	bigHandle := append([]byte{}, valid...)
+	*(*uint32)(unsafe.Pointer(&bigHandle[12])) = 64
+
+	tests := map[string][]byte{
+		"empty":          nil,
+		"header only":    valid[:3],
+		"truncated":      truncated,
+		"short length":   shortLen,
+		"handle too big": bigHandle,
+		"no dfid":        fidInfo(unix.FAN_EVENT_INFO_TYPE_FID, fsid, 1, []byte{1, 2, 3, 4}, ""),
+	}
+
+	for name, info := range tests {
+		if got, ok := parseFidRecord(info); ok {
+			t.Errorf("%s: parsed as %+v", name, got)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package core
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
@@ -19,66 +18,90 @@ var (
 	stateMountUnitName = "usr.mount"
 )
 
-func init() {
-	if !RootCheck(false) {
-		return
+func StateNew() (err error) {
+	unlock, err := LockOperation()
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	if err := os.MkdirAll(statesPath, 0755); err != nil {
-		fmt.Println(err)
-		return
-	}
+	// preparing a new folder in /var/almost/states for the new state
+	stateId := StateNextId()
 
-	if err := os.MkdirAll(statesTrashPath, 0755); err != nil {
-		fmt.Println(err)
-		return
+	env := HookEnv{"STATE_ID": stateId}
+	if err := RunPreHooks(HookStateNew, env); err != nil {
+		return err
 	}
-}
+	defer func() {
+		RunPostHooks(HookStateNew, env, err)
+	}()
 
-func StateNew() error {
-	// preparing a new folder in /var/almost/states for the new state
-	stateId := StateNextId()
 	statePath := fmt.Sprintf("%s/%s", statesPath, stateId)
+	if dryRun {
+		return previewStateNew(stateId, statePath)
+	}
+
 	if err := os.MkdirAll(statePath, 0755); err != nil {
-		fmt.Println("Error creating new folder for state with Id:", stateId, err)
-		return err
+		return fmt.Errorf("error creating new folder for state with Id %s: %w", stateId, err)
 	}
 
 	for _, dir := range []string{"data", "temp"} {
 		if err := os.MkdirAll(fmt.Sprintf("%s/%s", statePath, dir), 0755); err != nil {
-			fmt.Println("Error creating", dir, "directory:", err)
-			return err
+			return fmt.Errorf("error creating %s directory: %w", dir, err)
 		}
 	}
 
-	// creating a new overlay in the just created folder
-	if err := unix.Mount("overlay", stateSourcePath, "overlay", 0, fmt.Sprintf("lowerdir=%s,upperdir=%s/data,workdir=%s/temp", stateSourcePath, statePath, statePath)); err != nil {
-		fmt.Println("Error creating new overlay for state with Id:", stateId, err)
-		//fmt.Println("command was:", fmt.Sprintf("mount -t overlay overlay %s -o lowerdir=%s,upperdir=%s/data,workdir=%s/temp", stateSourcePath, stateSourcePath, statePath, statePath))
-		return err
+	// creating a new overlay in the just created folder, the target system
+	// mounts it on boot through the mount unit
+	if rootDir != "" {
+		logln("Skipping the mount of the new state, it is mounted on boot")
+	} else if err := unix.Mount("overlay", stateSourcePath, "overlay", 0, fmt.Sprintf("lowerdir=%s,upperdir=%s/data,workdir=%s/temp", stateSourcePath, statePath, statePath)); err != nil {
+		//logln("command was:", fmt.Sprintf("mount -t overlay overlay %s -o lowerdir=%s,upperdir=%s/data,workdir=%s/temp", stateSourcePath, stateSourcePath, statePath, statePath))
+		return fmt.Errorf("error creating new overlay for state with Id %s: %w", stateId, err)
 	}
 
 	// to avoid creating new timelines during a travel to the future, we
 	// need to empty the trash so that the new state lives in the same
 	// timeline as the older ones
-	StateEmptyTrash()
+	if err := StateEmptyTrash(); err != nil {
+		return err
+	}
 
 	// at this point the new state is mounted and ready to be used in the
 	// transaction, now we are going to re-generate the fstab file to
 	// include it, so that it will be mounted at boot
-	StateMountUnitRegenerate()
+	if err := stateMountUnitRegenerate(); err != nil {
+		return err
+	}
 
-	fmt.Println("New state created with Id:", stateId)
+	logln("New state created with Id:", stateId)
 
 	return nil
 }
 
+func previewStateNew(stateId, statePath string) error {
+	logf("Would create %s/data and %s/temp\n", statePath, statePath)
+	logf("Would mount overlay on %s (lowerdir=%s,upperdir=%s/data,workdir=%s/temp)\n",
+		stateSourcePath, stateSourcePath, statePath, statePath)
+	logf("Would empty %s\n", statesTrashPath)
+
+	states, _, err := StateList()
+	if err != nil {
+		return err
+	}
+	return writeStateMountUnit(append(states, stateId))
+}
+
 func StateList() ([]string, []string, error) {
 	states := []string{}
 	trashedStates := []string{}
 
-	// listing all states
+	// listing all states, the directories are created along with the
+	// first state
 	files, err := os.ReadDir(statesPath)
+	if os.IsNotExist(err) {
+		return states, trashedStates, nil
+	}
 	if err != nil {
 		return states, trashedStates, err
 	}
@@ -93,6 +116,9 @@ func StateList() ([]string, []string, error) {
 
 	// listing all trashed states
 	files, err = os.ReadDir(statesTrashPath)
+	if os.IsNotExist(err) {
+		return states, trashedStates, nil
+	}
 	if err != nil {
 		return states, trashedStates, err
 	}
@@ -136,41 +162,71 @@ func StateStatus() error {
 		return err
 	}
 
-	fmt.Println("States")
-	fmt.Println("----------------")
+	logln("States")
+	logln("----------------")
 	for _, state := range states {
-		fmt.Println("[" + state + "]")
+		logln("[" + state + "]")
 	}
 
-	fmt.Println("Trashed States")
-	fmt.Println("----------------")
+	logln("Trashed States")
+	logln("----------------")
 	for _, state := range trashedStates {
-		fmt.Println("[" + state + "]")
+		logln("[" + state + "]")
 	}
 
 	return nil
 }
 
 func StateTrash(id string) error {
+	unlock, err := LockOperation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// checking if the state exists
 	statePath := fmt.Sprintf("%s/%s", statesPath, id)
 	if _, err := os.Stat(statePath); os.IsNotExist(err) {
 		return fmt.Errorf("state with Id %s does not exist", id)
 	}
 
-	// unmounting the state
-	if err := unix.Unmount(statePath, 0); err != nil {
-		return err
+	if dryRun {
+		logf("Would unmount %s\n", statePath)
+		logf("Would move %s to %s\n", statePath, statesTrashPath)
+		states, _, err := StateList()
+		if err != nil {
+			return err
+		}
+		remaining := []string{}
+		for _, state := range states {
+			if state != id {
+				remaining = append(remaining, state)
+			}
+		}
+		return writeStateMountUnit(remaining)
+	}
+
+	// unmounting the state, the states of the target system are not
+	// mounted
+	if rootDir == "" {
+		if err := unix.Unmount(statePath, 0); err != nil {
+			return err
+		}
 	}
 
 	// moving the state to trash
+	if err := os.MkdirAll(statesTrashPath, 0755); err != nil {
+		return err
+	}
 	if err := os.Rename(statePath, fmt.Sprintf("%s/%s", statesTrashPath, id)); err != nil {
 		return err
 	}
 
-	StateMountUnitRegenerate()
+	if err := stateMountUnitRegenerate(); err != nil {
+		return err
+	}
 
-	fmt.Println("State", id, "trashed")
+	logln("State", id, "trashed")
 
 	return nil
 }
@@ -188,6 +244,18 @@ func StateEmptyTrash() error {
 }
 
 func StateMountUnitRegenerate() error {
+	unlock, err := LockOperation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return stateMountUnitRegenerate()
+}
+
+// stateMountUnitRegenerate writes the mount unit, the caller holds the
+// operation lock
+func stateMountUnitRegenerate() error {
 	/*
 		This function is responsible for generating the mount unit file for the
 		new state three. Once the state is created, it is mounted in real time
@@ -212,26 +280,41 @@ func StateMountUnitRegenerate() error {
 		WantedBy=systemd-remount-fs.service
 	*/
 
-	// preparing the list of states, sorted by if from lowest to highest
-	// so that the lower states are mounted first to keep the three
-	// consistent
 	states, _, err := StateList()
 	if err != nil {
 		return err
 	}
+
+	return writeStateMountUnit(states)
+}
+
+// writeStateMountUnit writes and enables the mount unit stacking the given
+// states, or removes it if there are none, in dry-run mode the unit is
+// printed instead
+func writeStateMountUnit(states []string) error {
+	if len(states) == 0 {
+		return removeStateMountUnit()
+	}
+
+	// preparing the list of states, sorted by if from lowest to highest
+	// so that the lower states are mounted first to keep the three
+	// consistent
 	sort.Slice(states, func(i, j int) bool {
 		return states[i] < states[j]
 	})
 
 	// preparing values for the Options field
+	// the unit is read by the target system, so the paths must not include
+	// the alternate root
+	targetStatesPath := unrooted(statesPath)
 	lowerdir := fmt.Sprintf("%s:", stateSourcePath)
 	for _, state := range states[:len(states)-1] {
-		lowerdir += fmt.Sprintf("%s/%s/data:", statesPath, state)
+		lowerdir += fmt.Sprintf("%s/%s/data:", targetStatesPath, state)
 	}
 
 	lowerdir = strings.TrimSuffix(lowerdir, ":")
-	upperdir := fmt.Sprintf("%s/%s/data", statesPath, states[len(states)-1])
-	workdir := fmt.Sprintf("%s/%s/temp", statesPath, states[len(states)-1])
+	upperdir := fmt.Sprintf("%s/%s/data", targetStatesPath, states[len(states)-1])
+	workdir := fmt.Sprintf("%s/%s/temp", targetStatesPath, states[len(states)-1])
 	optionsField := fmt.Sprintf("auto,lowerdir=%s,upperdir=%s,workdir=%s", lowerdir, upperdir, workdir)
 
 	// preparing and writing the new mount unit
@@ -250,25 +333,59 @@ Options=` + optionsField + `
 [Install]
 WantedBy=systemd-remount-fs.service`
 
+	if dryRun {
+		logf("Would write %s and enable %s:\n%s\n", stateMountUnitPath, stateMountUnitName, newSysUnit)
+		return nil
+	}
+
 	if err := os.WriteFile(stateMountUnitPath, []byte(newSysUnit), 0644); err != nil {
 		return err
 	}
 
 	// reloading the systemd daemon to make systemd aware of the new unit
-	if err := exec.Command("systemctl", "daemon-reload").Run(); err != nil {
+	if err := systemctl("daemon-reload"); err != nil {
 		return err
 	}
 
 	// enabling the new unit so that it is mounted at boot time
-	if err := exec.Command("systemctl", "enable", stateMountUnitName).Run(); err != nil {
+	if err := systemctl("enable", stateMountUnitName); err != nil {
+		return err
+	}
+
+	logln("State mount unit regenerated")
+	return nil
+}
+
+func removeStateMountUnit() error {
+	if _, err := os.Stat(stateMountUnitPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	if dryRun {
+		logf("Would disable %s and remove %s\n", stateMountUnitName, stateMountUnitPath)
+		return nil
+	}
+
+	if err := systemctl("disable", stateMountUnitName); err != nil {
+		return err
+	}
+	if err := os.Remove(stateMountUnitPath); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
 		return err
 	}
 
-	fmt.Println("State mount unit regenerated")
+	logln("State mount unit removed")
 	return nil
 }
 
 func StateRollback(id string) error {
+	if dryRun {
+		logln("State rollback is not implemented yet, nothing would change")
+		return nil
+	}
+
 	// unmount all states after the given id, plus the given id
 	// move the states to trash
 	// regenerate the mount unit
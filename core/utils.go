@@ -1,40 +1,110 @@
 package core
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
-var almostDir = "/etc/almost"
+// ErrNotRoot is returned by the operations which need root privileges
+var ErrNotRoot = errors.New("you must be root to run this operation")
 
-func init() {
-	if !RootCheck(false) {
-		return
-	}
-	if _, err := os.Stat(almostDir); os.IsNotExist(err) {
-		if err := os.Mkdir(almostDir, 0755); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-	}
-}
+var (
+	almostDir = "/etc/almost"
+	dryRun    = false
+	// output receives the messages printed by the operations
+	output io.Writer = os.Stdout
+)
 
 func RootCheck(display bool) bool {
 	if os.Geteuid() != 0 {
 		if display {
-			fmt.Println("You must be root to run this command")
+			logln("You must be root to run this command")
 		}
 		return false
 	}
 	return true
 }
 
-func AskConfirmation(s string) bool {
-	var response string
-	fmt.Print(s + " [y/N]: ")
-	fmt.Scanln(&response)
-	if response == "y" || response == "Y" {
-		return true
+/*
+SetOutput redirects the messages printed by the operations, io.Discard
+silences them.
+*/
+func SetOutput(w io.Writer) {
+	output = w
+}
+
+/*
+SetDryRun makes the operations changing the system print what they would
+do instead of doing it.
+*/
+func SetDryRun(enabled bool) {
+	dryRun = enabled
+}
+
+/*
+DryRun reports whether the operations only print what they would do.
+*/
+func DryRun() bool {
+	return dryRun
+}
+
+func logln(a ...interface{}) {
+	fmt.Fprintln(output, a...)
+}
+
+func logf(format string, a ...interface{}) {
+	fmt.Fprintf(output, format, a...)
+}
+
+// joinErrors returns the non nil errors combined in one, nil if there is
+// none, errors.Join needs Go 1.20
+func joinErrors(errs ...error) error {
+	var first error
+	messages := []string{}
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if first == nil {
+			first = err
+		}
+		messages = append(messages, err.Error())
+	}
+
+	if len(messages) < 2 {
+		return first
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// writeFileAtomic replaces the file at once, creating its directory if
+// needed, the content is flushed to disk before the rename so that a crash
+// leaves either the old or the new file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
 	}
-	return false
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
 }
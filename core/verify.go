@@ -0,0 +1,113 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+Drift describes a file whose attributes do not match the mode the system
+is in.
+*/
+type Drift struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Fixed    bool   `json:"fixed"`
+	Error    string `json:"error,omitempty"`
+}
+
+/*
+VerifyReport is the result of a verification of the managed paths.
+*/
+type VerifyReport struct {
+	Mode     string            `json:"mode,omitempty"`
+	Paths    map[string]string `json:"paths"`
+	Checked  int               `json:"checked"`
+	Skipped  int               `json:"skipped"`
+	Drifts   []Drift           `json:"drifts"`
+	Failures []string          `json:"failures"`
+}
+
+/*
+Verify walks the managed paths and reports every file whose attributes do
+not match the given mode, or the current mode of each path if empty. If fix
+is set, the drifted files are corrected.
+*/
+func Verify(mode string, fix bool, verbose bool) (VerifyReport, error) {
+	report := VerifyReport{
+		Mode:     mode,
+		Paths:    map[string]string{},
+		Drifts:   []Drift{},
+		Failures: []string{},
+	}
+
+	if fix {
+		unlock, err := LockOperation()
+		if err != nil {
+			return report, err
+		}
+		defer unlock()
+	}
+
+	rules, err := LoadPathRules()
+	if err != nil {
+		return report, err
+	}
+
+	ctx, err := NewBackendContext(rules, verbose)
+	if err != nil {
+		return report, err
+	}
+
+	for _, path := range rules.Resolve() {
+		pathMode := mode
+		if pathMode == "" {
+			pathMode = ctx.State.ModeOf(path)
+		}
+		if pathMode != ModeRo && pathMode != ModeRw {
+			report.Failures = append(report.Failures, fmt.Sprintf("%s: in mixed mode, the expected mode must be given", path))
+			continue
+		}
+		report.Paths[path] = pathMode
+
+		if verbose {
+			logln("Verifying: ", path)
+		}
+
+		backend, _, err := rules.BackendFor(path, ctx)
+		if err != nil {
+			report.Failures = append(report.Failures, err.Error())
+			continue
+		}
+
+		drifts, summary := backend.Verify(path, pathMode, fix)
+		report.Drifts = append(report.Drifts, drifts...)
+		report.Checked += summary.Changed + summary.Unchanged
+		report.Skipped += summary.Skipped
+		for _, failure := range summary.Failures {
+			report.Failures = append(report.Failures, failure.Error())
+		}
+	}
+
+	// fixing bind mounts changes the state
+	if fix {
+		if err := ctx.State.Save(); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+/*
+AttrNames returns a readable representation of the attributes, "none" if
+no attribute is set.
+*/
+func AttrNames(attrs int32) string {
+	names := AttrFlagNames(attrs)
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
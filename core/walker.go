@@ -0,0 +1,181 @@
+package core
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+/*
+WalkOptions defines how the walker traverses a managed path.
+*/
+type WalkOptions struct {
+	// MaxDepth is the maximum depth the walker descends below the root,
+	// 0 means only the root itself, a negative value means no limit.
+	MaxDepth int
+
+	// CrossMounts allows the walker to descend into file systems mounted
+	// below the root, by default mount points are skipped.
+	CrossMounts bool
+
+	// Exclude holds glob patterns, matching entries are skipped together
+	// with their content.
+	Exclude []string
+
+	// Special passes symlinks, device nodes, sockets and fifos to the
+	// callback too, instead of skipping them.
+	Special bool
+}
+
+/*
+WalkSummary counts what happened to the entries visited by the walker.
+*/
+type WalkSummary struct {
+	Changed   int
+	Unchanged int
+	Skipped   int
+	Failed    int
+	Failures  []FileError
+}
+
+/*
+FileError describes the failure occurred while processing a single file.
+*/
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e FileError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+/*
+WalkFunc is called for every entry the walker accepts, it returns whether
+the entry has been changed.
+*/
+type WalkFunc func(path string, d fs.DirEntry) (bool, error)
+
+/*
+Add merges the counters of another summary into this one.
+*/
+func (s *WalkSummary) Add(other WalkSummary) {
+	s.Changed += other.Changed
+	s.Unchanged += other.Unchanged
+	s.Skipped += other.Skipped
+	s.Failed += other.Failed
+	s.Failures = append(s.Failures, other.Failures...)
+}
+
+func (s *WalkSummary) fail(path string, err error) {
+	s.Failed++
+	s.Failures = append(s.Failures, FileError{Path: path, Err: err})
+}
+
+/*
+Total returns the number of entries visited by the walker.
+*/
+func (s WalkSummary) Total() int {
+	return s.Changed + s.Unchanged + s.Skipped + s.Failed
+}
+
+/*
+DefaultWalkOptions returns the walk options based on the configuration.
+*/
+func DefaultWalkOptions() WalkOptions {
+	return WalkOptions{MaxDepth: GetInt("Almost::MaxDepth")}
+}
+
+/*
+Walk recursively visits root and calls fn for every regular file and
+directory found. Symlinks, device nodes, sockets and fifos are skipped since
+they do not carry their own attributes (or opening them has side effects),
+unless Special is set, and so are mount points unless CrossMounts is set.
+*/
+func Walk(root string, opts WalkOptions, fn WalkFunc) (WalkSummary, error) {
+	var summary WalkSummary
+
+	rootInfo, err := os.Lstat(root)
+	if err != nil {
+		return summary, err
+	}
+	rootDev := deviceOf(rootInfo)
+	root = filepath.Clean(root)
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			summary.fail(path, err)
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if opts.MaxDepth >= 0 && walkDepth(root, path) > opts.MaxDepth {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if matchAny(opts.Exclude, path) {
+			summary.Skipped++
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.Type().IsRegular() && !d.IsDir() && !opts.Special {
+			summary.Skipped++
+			return nil
+		}
+
+		if d.IsDir() && !opts.CrossMounts && path != root {
+			info, err := d.Info()
+			if err != nil {
+				summary.fail(path, err)
+				return filepath.SkipDir
+			}
+			if deviceOf(info) != rootDev {
+				summary.Skipped++
+				return filepath.SkipDir
+			}
+		}
+
+		changed, err := fn(path, d)
+		switch {
+		case err != nil:
+			summary.fail(path, err)
+		case changed:
+			summary.Changed++
+		default:
+			summary.Unchanged++
+		}
+
+		return nil
+	})
+
+	return summary, err
+}
+
+func walkDepth(root, path string) int {
+	rel := strings.TrimPrefix(strings.TrimPrefix(path, root), "/")
+	if rel == "" {
+		return 0
+	}
+	return strings.Count(rel, "/") + 1
+}
+
+func deviceOf(info fs.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev)
+	}
+	return 0
+}
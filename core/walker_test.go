@@ -0,0 +1,132 @@
+package core
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestWalk(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"dir/sub", "skip"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"a.txt", "dir/b.txt", "dir/sub/c.txt", "skip/d.txt"} {
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mkfifo(filepath.Join(root, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	errFailed := errors.New("failed")
+	// unchanged visits every entry without changing it, touch changes the
+	// text files and fails on b.txt
+	unchanged := func(string) (bool, error) { return false, nil }
+	touch := func(rel string) (bool, error) {
+		if rel == "dir/b.txt" {
+			return false, errFailed
+		}
+		return strings.HasSuffix(rel, ".txt"), nil
+	}
+
+	tests := []struct {
+		name    string
+		opts    WalkOptions
+		fn      func(rel string) (bool, error)
+		visited []string
+		want    WalkSummary
+	}{
+		{
+			name:    "no limit",
+			opts:    WalkOptions{MaxDepth: -1},
+			fn:      unchanged,
+			visited: []string{".", "a.txt", "dir", "dir/b.txt", "dir/sub", "dir/sub/c.txt", "skip", "skip/d.txt"},
+			want:    WalkSummary{Unchanged: 8, Skipped: 2},
+		},
+		{
+			name:    "root only",
+			opts:    WalkOptions{MaxDepth: 0},
+			fn:      unchanged,
+			visited: []string{"."},
+			want:    WalkSummary{Unchanged: 1},
+		},
+		{
+			name:    "depth limit",
+			opts:    WalkOptions{MaxDepth: 1},
+			fn:      unchanged,
+			visited: []string{".", "a.txt", "dir", "skip"},
+			want:    WalkSummary{Unchanged: 4, Skipped: 2},
+		},
+		{
+			name:    "exclude",
+			opts:    WalkOptions{MaxDepth: -1, Exclude: []string{filepath.Join(root, "skip"), filepath.Join(root, "dir/sub/*")}},
+			fn:      unchanged,
+			visited: []string{".", "a.txt", "dir", "dir/b.txt", "dir/sub"},
+			want:    WalkSummary{Unchanged: 5, Skipped: 4},
+		},
+		{
+			name:    "special",
+			opts:    WalkOptions{MaxDepth: 1, Special: true},
+			fn:      unchanged,
+			visited: []string{".", "a.txt", "dir", "fifo", "link", "skip"},
+			want:    WalkSummary{Unchanged: 6},
+		},
+		{
+			name:    "counters",
+			opts:    WalkOptions{MaxDepth: -1},
+			fn:      touch,
+			visited: []string{".", "a.txt", "dir", "dir/b.txt", "dir/sub", "dir/sub/c.txt", "skip", "skip/d.txt"},
+			want: WalkSummary{
+				Changed:   3,
+				Unchanged: 4,
+				Skipped:   2,
+				Failed:    1,
+				Failures:  []FileError{{Path: filepath.Join(root, "dir/b.txt"), Err: errFailed}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		visited := []string{}
+		got, err := Walk(root, test.opts, func(path string, d fs.DirEntry) (bool, error) {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return false, err
+			}
+			visited = append(visited, rel)
+			return test.fn(rel)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(visited, test.visited) {
+			t.Errorf("%s: visited %v, want %v", test.name, visited, test.visited)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: summary %+v, want %+v", test.name, got, test.want)
+		}
+		if got.Total() != len(test.visited)+test.want.Skipped {
+			t.Errorf("%s: total %d, want %d", test.name, got.Total(), len(test.visited)+test.want.Skipped)
+		}
+	}
+
+	if _, err := Walk(filepath.Join(root, "missing"), WalkOptions{}, func(string, fs.DirEntry) (bool, error) {
+		return false, nil
+	}); !os.IsNotExist(err) {
+		t.Errorf("missing root: got %v, want a not exist error", err)
+	}
+}
@@ -0,0 +1,315 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const windowUnitName = "almost-relock"
+
+/*
+Window is a time-limited read-write session, the paths are locked again
+automatically once it expires.
+*/
+type Window struct {
+	// Paths holds the managed paths or groups unlocked by the window, all
+	// if empty
+	Paths   []string  `json:"paths,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+/*
+Remaining returns the time left before the window expires.
+*/
+func (w *Window) Remaining() time.Duration {
+	remaining := time.Until(w.Expires)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+/*
+OpenWindow unlocks the given paths and schedules their relock once the
+given duration has elapsed, even if the calling process is gone by then.
+*/
+func OpenWindow(duration time.Duration, opts TransitionOptions) error {
+	if duration <= 0 {
+		return fmt.Errorf("the window duration must be positive")
+	}
+	if err := requireLiveSystem("a read-write window"); err != nil {
+		return err
+	}
+
+	unlock, err := LockOperation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := enterMode(ModeRw, opts); err != nil {
+		return err
+	}
+
+	window := &Window{Paths: opts.Paths, Expires: time.Now().Add(duration)}
+	if dryRun {
+		logf("Would schedule the relock at %s.\n", window.Expires.Format(time.Kitchen))
+		return nil
+	}
+	if err := scheduleRelock(window); err != nil {
+		return err
+	}
+
+	logf("Read-write window open, relocking at %s.\n", window.Expires.Format(time.Kitchen))
+	return nil
+}
+
+/*
+ExtendWindow postpones the expiration of the current window.
+*/
+func ExtendWindow(duration time.Duration) error {
+	unlock, err := LockOperation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	window, err := CurrentWindow()
+	if err != nil {
+		return err
+	}
+	if window == nil {
+		return fmt.Errorf("no read-write window is open")
+	}
+
+	if window.Expires.Before(time.Now()) {
+		window.Expires = time.Now()
+	}
+	window.Expires = window.Expires.Add(duration)
+
+	if err := scheduleRelock(window); err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+
+	logf("Read-write window extended, relocking at %s.\n", window.Expires.Format(time.Kitchen))
+	return nil
+}
+
+/*
+CancelWindow drops the current window, the paths are locked right away if
+relock is set, otherwise they stay read-write.
+*/
+func CancelWindow(relock bool, opts TransitionOptions) error {
+	unlock, err := LockOperation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	window, err := CurrentWindow()
+	if err != nil {
+		return err
+	}
+	if window == nil {
+		return fmt.Errorf("no read-write window is open")
+	}
+
+	if err := clearWindow(); err != nil {
+		return err
+	}
+
+	if !relock {
+		logln("Read-write window cancelled, the system stays read-write.")
+		return nil
+	}
+
+	opts.Paths = window.Paths
+	return enterMode(ModeRo, opts)
+}
+
+/*
+ExpireWindow locks the paths of the current window if it has expired, it
+is called by the relock timer.
+*/
+func ExpireWindow(opts TransitionOptions) error {
+	unlock, err := LockOperation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	window, err := CurrentWindow()
+	if err != nil {
+		return err
+	}
+	if window == nil {
+		return nil
+	}
+	if window.Remaining() > 0 {
+		logln("The read-write window has been extended, nothing to do.")
+		return nil
+	}
+
+	logln("The read-write window has expired.")
+
+	// the last lease released locks the system instead
+	state, _, err := reapLeases()
+	if err != nil {
+		return err
+	}
+	if len(state.Leases) > 0 {
+		logf("Relock deferred, %d lease(s) still active.\n", len(state.Leases))
+		if err := deferRelock(state, window.Paths); err != nil {
+			return err
+		}
+		return clearWindow()
+	}
+
+	// the leases released while the window was open left their paths
+	// unlocked
+	opts.Paths = window.Paths
+	if len(opts.Paths) > 0 {
+		opts.Paths = appendMissing(append([]string{}, window.Paths...), state.LeasePaths)
+	}
+	opts.Reason = "read-write window expired"
+	if err := enterMode(ModeRo, opts); err != nil {
+		return err
+	}
+
+	return clearWindow()
+}
+
+/*
+CurrentWindow returns the open read-write window, nil if there is none.
+*/
+func CurrentWindow() (*Window, error) {
+	state, err := LoadModeState()
+	if err != nil {
+		return nil, err
+	}
+
+	return state.Window, nil
+}
+
+/*
+SuperviseWindow waits for the current window to expire and locks its
+paths, it is the fallback used when no systemd timer can be created.
+*/
+func SuperviseWindow(opts TransitionOptions) error {
+	for {
+		// the leases of processes which died meanwhile would defer the
+		// relock forever
+		if err := ReapLeases(opts); err != nil {
+			logln("Error reaping the dead leases:", err)
+		}
+
+		window, err := CurrentWindow()
+		if err != nil {
+			return err
+		}
+		if window == nil {
+			return nil
+		}
+
+		remaining := window.Remaining()
+		if remaining == 0 {
+			return ExpireWindow(opts)
+		}
+
+		// waking up from time to time to notice extensions and
+		// cancellations
+		if remaining > 30*time.Second {
+			remaining = 30 * time.Second
+		}
+		time.Sleep(remaining)
+	}
+}
+
+func scheduleRelock(window *Window) error {
+	if dryRun {
+		logf("Would schedule the relock at %s.\n", window.Expires.Format(time.Kitchen))
+		return nil
+	}
+
+	state, err := LoadModeState()
+	if err != nil {
+		return err
+	}
+	state.Window = window
+	if err := state.Save(); err != nil {
+		return err
+	}
+
+	stopRelockTimer()
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	seconds := int(window.Remaining().Seconds()) + 1
+	err = exec.Command("systemd-run",
+		"--unit="+windowUnitName,
+		"--description=Relock the system when the almost read-write window expires",
+		fmt.Sprintf("--on-active=%ds", seconds),
+		"--timer-property=AccuracySec=1s",
+		self, "window", "expire", "--wait", "10m").Run()
+	if err == nil {
+		return nil
+	}
+
+	// without systemd, a detached process takes care of the relock, it
+	// lives in its own session so it survives the terminal
+	logln("Could not create the relock timer, falling back to a supervising process:", err)
+	cmd := exec.Command(self, "window", "supervise", "--wait", "10m")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+func stopRelockTimer() {
+	timer, service := windowUnitName+".timer", windowUnitName+".service"
+
+	// the timer is gone once it has fired, or if the supervising process
+	// is used instead
+	if systemctl("is-active", "--quiet", timer) == nil {
+		if err := systemctl("stop", timer); err != nil {
+			logln("Error stopping the relock timer:", err)
+		}
+	}
+
+	// failed units would keep systemd-run from reusing their name
+	for _, unit := range []string{timer, service} {
+		if systemctl("is-failed", "--quiet", unit) == nil {
+			if err := systemctl("reset-failed", unit); err != nil {
+				logln("Error resetting the relock unit:", err)
+			}
+		}
+	}
+}
+
+func clearWindow() error {
+	state, err := LoadModeState()
+	if err != nil {
+		return err
+	}
+	if state.Window == nil {
+		return nil
+	}
+	if dryRun {
+		logln("Would close the read-write window and stop the relock timer.")
+		return nil
+	}
+
+	stopRelockTimer()
+	state.Window = nil
+	return state.Save()
+}
@@ -5,24 +5,10 @@ go 1.18
 require (
 	github.com/spf13/cobra v1.5.0
 	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f
+	gopkg.in/ini.v1 v1.67.0
 )
 
-require (
-	github.com/fsnotify/fsnotify v1.5.4 // indirect
-	github.com/hashicorp/hcl v1.0.0 // indirect
-	github.com/magiconair/properties v1.8.6 // indirect
-	github.com/mitchellh/mapstructure v1.5.0 // indirect
-	github.com/pelletier/go-toml v1.9.5 // indirect
-	github.com/pelletier/go-toml/v2 v2.0.5 // indirect
-	github.com/spf13/afero v1.8.2 // indirect
-	github.com/spf13/cast v1.5.0 // indirect
-	github.com/spf13/jwalterweatherman v1.1.0 // indirect
-	github.com/subosito/gotenv v1.4.1 // indirect
-	golang.org/x/text v0.3.8 // indirect
-	gopkg.in/ini.v1 v1.67.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
-)
+require github.com/stretchr/testify v1.8.0 // indirect
 
 require (
 	github.com/godbus/dbus/v5 v5.1.0
@@ -31,5 +17,4 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.15
 	github.com/otiai10/copy v1.7.0
 	github.com/spf13/pflag v1.0.5 // indirect
-	github.com/spf13/viper v1.13.0
 )
@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/vanilla-os/almost/cmd"
+	"github.com/vanilla-os/almost/core"
 )
 
 var (
@@ -19,6 +21,11 @@ Options:
 	--help/-h		show this message
 	--verbose/-v		show more verbosity
 	--version/-V		show version
+	--wait [duration]	wait for another almost operation to finish
+				instead of failing right away
+	--root [dir]		operate on the system installed in dir, e.g. a
+				chroot or a disk image, mounts are made on its
+				first boot
 
 Commands:
 	enter			set the filesystem as ro or rw until reboot
@@ -29,6 +36,10 @@ Commands:
 	overlay			overlay a directory
 	status			show information about the current state
 	state			manage persistent overlays
+	verify			verify the immutability of the managed paths
+	window			manage the time-limited read-write window
+	attr			show and change the file attributes
+	sessions		show the changes made during the read-write sessions
 `)
 }
 
@@ -42,6 +53,14 @@ func newAlmostCommand() *cobra.Command {
 
 func main() {
 	rootCmd := newAlmostCommand()
+	rootCmd.PersistentFlags().Duration("wait", 0, "wait for another almost operation to finish")
+	rootCmd.PersistentFlags().String("root", "", "operate on the system installed in the given directory")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		wait, _ := cmd.Flags().GetDuration("wait")
+		core.SetLockWait(wait)
+		root, _ := cmd.Flags().GetString("root")
+		return core.SetRoot(root)
+	}
 	rootCmd.AddCommand(cmd.NewEnterCommand())
 	rootCmd.AddCommand(cmd.NewConfigCommand())
 	rootCmd.AddCommand(cmd.NewCheckCommand())
@@ -51,6 +70,13 @@ func main() {
 	rootCmd.AddCommand(cmd.NewStatusCommand())
 	rootCmd.AddCommand(cmd.NewStateCommand())
 	rootCmd.AddCommand(cmd.NewOfflineUpdateCommand())
+	rootCmd.AddCommand(cmd.NewVerifyCommand())
+	rootCmd.AddCommand(cmd.NewWindowCommand())
+	rootCmd.AddCommand(cmd.NewAttrCommand())
+	rootCmd.AddCommand(cmd.NewSessionsCommand())
 	rootCmd.SetHelpFunc(help)
-	rootCmd.Execute()
+	// cobra has printed the error already
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
 }